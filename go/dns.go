@@ -1,1403 +1,434 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
-
+	"math/bits"
 	"net"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cespare/xxhash"
+	"github.com/isucon/isucon13/webapp/go/isuutil"
 	"github.com/miekg/dns"
 )
 
-var domain = "u.isucon.dev"
-var addr = ":53"
+// domain は本番のゾーン名です。loadDNSConfig で設定から読み込まれる。
+var domain = defaultDNSZone
 var ErrNotFound = fmt.Errorf("not found")
 
-var initialSubdomains = []string{
-	"ns1",
-	"pipe",
-	"test001",
-	"www",
-	"www1",
-	"www2",
-	"www3",
-	"www4",
-	"www5",
-	"mail",
-	"acr-nema",
-	"afpovertcp",
-	"afs3-bos",
-	"afs3-callback",
-	"afs3-fileserve",
-	"afs3-kaserver",
-	"afs3-prserver",
-	"afs3-rmtsys",
-	"afs3-update",
-	"afs3-vlserver",
-	"afs3-volser",
-	"amanda",
-	"amandaidx",
-	"amidxtape",
-	"amqp",
-	"amqps",
-	"asf-rmcp",
-	"asp",
-	"auth",
-	"babel",
-	"bacula-dir",
-	"bacula-fd",
-	"bacula-sd",
-	"bbs",
-	"bgp",
-	"bgpd",
-	"biff",
-	"binkp",
-	"bootpc",
-	"bootps",
-	"canna",
-	"cfengine",
-	"chargen",
-	"cisco-sccp",
-	"clc-build-daemon",
-	"clearcase",
-	"cmip-agent",
-	"cmip-man",
-	"codaauth2",
-	"codasrv",
-	"codasrv-se",
-	"csync2",
-	"cvspserver",
-	"daap",
-	"datametrics",
-	"daytime",
-	"db-lsp",
-	"dcap",
-	"dhcpv6-client",
-	"dhcpv6-server",
-	"dicom",
-	"dict",
-	"dircproxy",
-	"discard",
-	"distcc",
-	"domain",
-	"domain-s",
-	"echo",
-	"epmap",
-	"epmd",
-	"exec",
-	"f5-globalsite",
-	"f5-iquery",
-	"fax",
-	"fido",
-	"finger",
-	"font-service ",
-	"freeciv",
-	"fsp",
-	"ftp",
-	"ftp-data",
-	"ftps",
-	"ftps-data",
-	"gdomap",
-	"gds-db",
-	"git",
-	"gnunet",
-	"gnutella-rtr ",
-	"gnutella-svc ",
-	"gopher",
-	"gpsd",
-	"gris",
-	"groupwise",
-	"gsidcap",
-	"gsiftp",
-	"gsigatekeeper",
-	"hkp",
-	"http",
-	"http-alt",
-	"https",
-	"hylafax",
-	"iax",
-	"icpv2",
-	"imap2",
-	"imaps",
-	"ingreslock",
-	"ipp",
-	"iprop",
-	"ipsec-nat-t",
-	"ipx",
-	"ircd",
-	"ircs-u",
-	"isakmp",
-	"iscsi-target ",
-	"isisd",
-	"isns",
-	"iso-tsap",
-	"kamandakerberos",
-	"kerberos-adm",
-	"kerberos-master",
-	"kerberos4",
-	"kermit",
-	"klogin",
-	"kpasswd",
-	"krb-prop",
-	"kshell",
-	"l2f",
-	"ldap",
-	"ldaps",
-	"ldp",
-	"login",
-	"lotusnote",
-	"mailq",
-	"mdns",
-	"microsoft-ds",
-	"moira-db",
-	"moira-update",
-	"moira-ureg",
-	"mon",
-	"ms-sql-m",
-	"ms-sql-s",
-	"ms-wbt-server",
-	"mtn",
-	"munin",
-	"mysql",
-	"mysql-proxy",
-	"nbd",
-	"nbp",
-	"netbios-dgm",
-	"netbios-ns",
-	"netbios-ssn",
-	"netstat",
-	"nfs",
-	"nntp",
-	"nntps",
-	"nqs",
-	"nrpe",
-	"nsca",
-	"ntalk",
-	"ntp",
-	"ntske",
-	"nut",
-	"omniorb",
-	"openvpn",
-	"ospf6d",
-	"ospfapi",
-	"ospfd",
-	"passwd-server",
-	"pawserv",
-	"pop3",
-	"pop3s",
-	"poppassd",
-	"postgresql",
-	"predict",
-	"printer",
-	"proofd",
-	"ptp-event",
-	"ptp-general",
-	"puppet",
-	"qmqp",
-	"qmtp",
-	"qotd",
-	"radius",
-	"radius-acct",
-	"radmin-port",
-	"redis",
-	"remctl",
-	"ripd",
-	"ripngd",
-	"rmiregistry",
-	"rmtcfg",
-	"rootd",
-	"route",
-	"rpc2portmap",
-	"rplay",
-	"rsync",
-	"rtcm-sc104",
-	"rtmp",
-	"rtsp",
-	"sa-msg-port",
-	"saft",
-	"sane-port",
-	"sge-execd",
-	"sge-qmaster",
-	"sgi-cad",
-	"sgi-cmsd",
-	"sgi-crsd",
-	"sgi-gcd",
-	"shell",
-	"sieve",
-	"silc",
-	"sip",
-	"sip-tls",
-	"skkserv",
-	"smtp",
-	"smux",
-	"snmp",
-	"snmp-trap",
-	"snpp",
-	"socks",
-	"spamd",
-	"ssh",
-	"submission",
-	"submissions",
-	"sunrpc",
-	"supfiledbg",
-	"supfilesrv",
-	"suucp",
-	"svn",
-	"svrloc",
-	"syslog",
-	"syslog-tls",
-	"sysrqd",
-	"systat",
-	"tacacs",
-	"talk",
-	"tcpmux",
-	"telnet",
-	"telnets",
-	"tfido",
-	"tftp",
-	"time",
-	"tinc",
-	"tproxy",
-	"uucp",
-	"venus",
-	"venus-se",
-	"webmin",
-	"who",
-	"whois",
-	"wnn6",
-	"x11",
-	"x11-1",
-	"x11-2",
-	"x11-3",
-	"x11-4",
-	"x11-5",
-	"x11-6",
-	"x11-7",
-	"xdmcp",
-	"xinetd",
-	"xmms2",
-	"xmpp-client",
-	"xmpp-server",
-	"xtel",
-	"xtelw",
-	"z3950",
-	"zabbix-agent",
-	"zabbix-trapper",
-	"zebra",
-	"zebrasrv",
-	"zephyr-clt",
-	"zephyr-hm",
-	"zephyr-srv",
-	"zip",
-	"zope",
-	"zope-ftp",
-	"zserv",
-	"ayamazaki0",
-	"yoshidamiki0",
-	"hidekimurakami0",
-	"akemikobayashi0",
-	"eishikawa0",
-	"tomoya100",
-	"kobayashiminoru0",
-	"yamadakaori0",
-	"tanakahanako0",
-	"taro660",
-	"hashimotokenichi0",
-	"yuta330",
-	"kenichinakamura0",
-	"taichikato0",
-	"wfujita0",
-	"saitotakuma0",
-	"maayafujiwara0",
-	"akira680",
-	"vmaeda0",
-	"jnakamura0",
-	"suzukitsubasa0",
-	"yoshidatomoya0",
-	"qendo0",
-	"haruka030",
-	"saitotakuma1",
-	"bsuzuki0",
-	"shohei720",
-	"naoko980",
-	"suzukiryohei0",
-	"kobayashisayuri0",
-	"ykobayashi0",
-	"asuzuki0",
-	"sotaro880",
-	"nyamaguchi0",
-	"momokohashimoto0",
-	"suzukinaoki0",
-	"wgoto0",
-	"tomoya540",
-	"fujitayoichi0",
-	"kaorikato0",
-	"chiyo810",
-	"yito0",
-	"tomoyakato0",
-	"ryosukeabe0",
-	"smatsumoto0",
-	"vwatanabe0",
-	"sayuri650",
-	"takahashinaoto0",
-	"hiroshisuzuki0",
-	"xyamamoto0",
-	"osaito0",
-	"esato0",
-	"oshimizu0",
-	"yamadamituru0",
-	"wmori0",
-	"saitorei0",
-	"kimuramiki0",
-	"sasakiyosuke0",
-	"kumiko410",
-	"qkobayashi0",
-	"akondo0",
-	"ywatanabe0",
-	"otanaoki0",
-	"naotosasaki0",
-	"momokosuzuki0",
-	"maayayoshida0",
-	"hashimotoasuka0",
-	"maayanakagawa0",
-	"ltanaka0",
-	"jyamada0",
-	"yasuhiro650",
-	"hiroshitanaka0",
-	"yamashitaakemi0",
-	"hidekiishikawa0",
-	"kanatakahashi0",
-	"akemiito0",
-	"manabu800",
-	"shota790",
-	"naokoaoki0",
-	"gyamamoto0",
-	"xyamaguchi0",
-	"katokumiko0",
-	"xyamada0",
-	"qyamashita0",
-	"pwatanabe0",
-	"ryoheiishikawa0",
-	"nakamuraharuka0",
-	"pfukuda0",
-	"saitoyosuke0",
-	"morijun0",
-	"hiroshiokamoto0",
-	"kazuyahayashi0",
-	"anakajima0",
-	"maaya110",
-	"kazuya250",
-	"kondoakira0",
-	"atsushi920",
-	"hanakokondo0",
-	"naoki220",
-	"hiroshi180",
-	"jun820",
-	"onakamura0",
-	"takuma040",
-	"kobayashiyasuhiro0",
-	"reiwatanabe0",
-	"hideki630",
-	"yutayoshida0",
-	"yutamori0",
-	"ryosukeyamamoto0",
-	"manabuota0",
-	"nsakamoto0",
-	"wtanaka0",
-	"inakamura0",
-	"ymori0",
-	"nfujii0",
-	"osamu950",
-	"yuinakagawa0",
-	"uhayashi0",
-	"momoko070",
-	"myamada0",
-	"zyoshida0",
-	"watanabesatomi0",
-	"watanabemanabu0",
-	"momokosuzuki1",
-	"jokada0",
-	"hanako640",
-	"rmatsumoto0",
-	"maayasasaki0",
-	"ryohei450",
-	"takuma570",
-	"yokotanaka0",
-	"mai270",
-	"rikasakamoto0",
-	"taro150",
-	"suzukimomoko0",
-	"watanabeyoichi0",
-	"yuki620",
-	"tsubasainoue0",
-	"yokotakahashi0",
-	"yumikohayashi0",
-	"yamaguchiyumiko0",
-	"kkato0",
-	"minoruyoshida0",
-	"tmurakami0",
-	"hasegawanaoto0",
-	"kumikowatanabe0",
-	"lota0",
-	"yoichi440",
-	"sayurikondo0",
-	"xogawa0",
-	"naoki250",
-	"eokada0",
-	"satomiyamamoto0",
-	"asukamaeda0",
-	"momokowatanabe0",
-	"nanamisuzuki0",
-	"gotomanabu0",
-	"maiyamazaki0",
-	"junito0",
-	"aokikazuya0",
-	"shohei040",
-	"momokotanaka0",
-	"atsushimatsumoto0",
-	"taichifukuda0",
-	"haruka630",
-	"tanakashohei0",
-	"qnishimura0",
-	"mkondo0",
-	"kimurayui0",
-	"tomoyanakajima0",
-	"naoko310",
-	"yukiokada0",
-	"tsubasasuzuki0",
-	"yutatakahashi0",
-	"kyosuke140",
-	"tomoya190",
-	"ryohei610",
-	"fukudahiroshi0",
-	"tyamaguchi0",
-	"rsasaki0",
-	"satoyoichi0",
-	"rikawatanabe0",
-	"vokada0",
-	"mituru070",
-	"nakajimayui0",
-	"nanamiota0",
-	"smatsuda0",
-	"suzukijun0",
-	"saitosayuri0",
-	"haruka730",
-	"yamamotoakemi0",
-	"satoyosuke0",
-	"maayasato0",
-	"nanami830",
-	"kanaokamoto0",
-	"usuzuki0",
-	"manabusasaki0",
-	"kenichi870",
-	"tomoyasato0",
-	"mituruhayashi0",
-	"junnishimura0",
-	"fujiwaramituru0",
-	"yoshidamai0",
-	"yosuke350",
-	"xwatanabe0",
-	"naokimatsumoto0",
-	"kenichi170",
-	"naoko340",
-	"nakajimasotaro0",
-	"eito0",
-	"kenichi470",
-	"qabe0",
-	"junkondo0",
-	"yosukewatanabe0",
-	"ryosuke040",
-	"itosotaro0",
-	"kimuramikako0",
-	"reiogawa0",
-	"myamada1",
-	"yamazakisayuri0",
-	"gotoakemi0",
-	"shohei660",
-	"phasegawa0",
-	"kana990",
-	"yosuke710",
-	"rika420",
-	"ikedajun0",
-	"takuma250",
-	"yoichihayashi0",
-	"yoichi441",
-	"zmiura0",
-	"ftakahashi0",
-	"oinoue0",
-	"osamu920",
-	"takahashikumiko0",
-	"tsubasamaeda0",
-	"ryosuke220",
-	"yoichimurakami0",
-	"abeyumiko0",
-	"tishii0",
-	"vkato0",
-	"mituru710",
-	"asukamurakami0",
-	"yuiwatanabe0",
-	"jokamoto0",
-	"akirafujiwara0",
-	"lgoto0",
-	"akiratakahashi0",
-	"lhashimoto0",
-	"ogawarika0",
-	"manabu620",
-	"osamuyamaguchi0",
-	"fujiwararei0",
-	"yosukewatanabe1",
-	"asuka500",
-	"otamaaya0",
-	"okamotonaoko0",
-	"tokamoto0",
-	"saitomituru0",
-	"suzukitakuma0",
-	"suzukimaaya0",
-	"nanamitanaka0",
-	"suzukikana0",
-	"sakamotoshohei0",
-	"kanayamamoto0",
-	"xtakahashi0",
-	"wsuzuki0",
-	"taichi990",
-	"saitoyuki0",
-	"rei050",
-	"nmaeda0",
-	"csuzuki0",
-	"takahashiatsushi0",
-	"yukifukuda0",
-	"yumiko680",
-	"yamadayoko0",
-	"abeosamu0",
-	"taro210",
-	"katomai0",
-	"hasegawakumiko0",
-	"vhashimoto0",
-	"tanakamai0",
-	"hmori0",
-	"naokoyamaguchi0",
-	"yamaguchiyuta0",
-	"iyamamoto0",
-	"yutanakajima0",
-	"kyosukesasaki0",
-	"satosatomi0",
-	"kkato1",
-	"kumiko980",
-	"jishii0",
-	"yutafujiwara0",
-	"fukudamomoko0",
-	"kumikokobayashi0",
-	"naoki350",
-	"sayuri230",
-	"morijun1",
-	"mituru840",
-	"eyoshida0",
-	"taichi460",
-	"esasaki0",
-	"yumikonakamura0",
-	"akemi540",
-	"kazuya770",
-	"suzukiharuka0",
-	"harukagoto0",
-	"vkato1",
-	"bmatsumoto0",
-	"yamazakikaori0",
-	"yamashitasatomi0",
-	"fujiimikako0",
-	"ekato0",
-	"asukaito0",
-	"aokimiki0",
-	"katotaichi0",
-	"harukasasaki0",
-	"manabuyamamoto0",
-	"etanaka0",
-	"nakagawamituru0",
-	"hiroshikobayashi0",
-	"satomi900",
-	"akira180",
-	"manabu710",
-	"minoru160",
-	"fujiwarataro0",
-	"tomoya240",
-	"taichinakajima0",
-	"atsushitakahashi0",
-	"yoichi150",
-	"fito0",
-	"satomitakahashi0",
-	"akemi230",
-	"akato0",
-	"asuka250",
-	"atsushiinoue0",
-	"sasakirei0",
-	"yamadamiki0",
-	"taro890",
-	"yamamotohiroshi0",
-	"vtakahashi0",
-	"yoichiyoshida0",
-	"nishimurashohei0",
-	"zsasaki0",
-	"shimizumaaya0",
-	"inoueosamu0",
-	"hsato0",
-	"kimuraharuka0",
-	"takumayoshida0",
-	"ikedahideki0",
-	"kobayashitsubasa0",
-	"jmurakami0",
-	"kaori320",
-	"suzukimiki0",
-	"gtanaka0",
-	"shota220",
-	"fyamada0",
-	"nishimuraminoru0",
-	"ttanaka0",
-	"satomi280",
-	"maaya390",
-	"snakamura0",
-	"okamototsubasa0",
-	"etakahashi0",
-	"taro500",
-	"yasuhirotakahashi0",
-	"uhasegawa0",
-	"miki470",
-	"ryosukeito0",
-	"kanasaito0",
-	"dyamashita0",
-	"taichi180",
-	"iyamazaki0",
-	"yui950",
-	"kumikomaeda0",
-	"yuiwatanabe1",
-	"suzukishota0",
-	"vsuzuki0",
-	"tanakahiroshi0",
-	"yosukekimura0",
-	"saitoryosuke0",
-	"ymori1",
-	"xnakajima0",
-	"zyamazaki0",
-	"mikakoyamamoto0",
-	"tanakahideki0",
-	"ekato1",
-	"momokomori0",
-	"tsubasa260",
-	"mikako290",
-	"yoko160",
-	"yuki480",
-	"hasegawakumiko1",
-	"itokana0",
-	"fkobayashi0",
-	"tomoya630",
-	"yuki730",
-	"vyamaguchi0",
-	"tshimizu0",
-	"pota0",
-	"hiroshi960",
-	"katoyui0",
-	"mkondo1",
-	"rika500",
-	"einoue0",
-	"yamashitayumiko0",
-	"kazuya680",
-	"asukakobayashi0",
-	"miki320",
-	"yumikosuzuki0",
-	"naotoito0",
-	"esuzuki0",
-	"hiroshiaoki0",
-	"vishikawa0",
-	"akiraito0",
-	"mikako020",
-	"miurasatomi0",
-	"etakahashi1",
-	"tarosato0",
-	"matsumotomanabu0",
-	"naoko560",
-	"kaori570",
-	"minoru210",
-	"jsuzuki0",
-	"tanakashohei1",
-	"tyamada0",
-	"kenichi160",
-	"shotayamada0",
-	"hiroshi070",
-	"hidekisakamoto0",
-	"naokiikeda0",
-	"nakagawamaaya0",
-	"hiroshitanaka1",
-	"yamashitamaaya0",
-	"momokoabe0",
-	"vito0",
-	"sakamotomikako0",
-	"asaito0",
-	"ryosukewatanabe0",
-	"nanami140",
-	"tanakahanako1",
-	"rei390",
-	"rito0",
-	"akemiinoue0",
-	"jendo0",
-	"cwatanabe0",
-	"rikakobayashi0",
-	"kaoriokamoto0",
-	"momoko350",
-	"sayuri130",
-	"kaoritanaka0",
-	"mikakokobayashi0",
-	"naoto500",
-	"suzukinaoto0",
-	"myamamoto0",
-	"yuta090",
-	"asato0",
-	"chiyo580",
-	"lmatsumoto0",
-	"kaori190",
-	"mai860",
-	"naokokimura0",
-	"tomoya400",
-	"dota0",
-	"osamu590",
-	"takahashitomoya0",
-	"shimizuakemi0",
-	"endokenichi0",
-	"yoshidaryohei0",
-	"ryosukemurakami0",
-	"reitanaka0",
-	"akemi910",
-	"enakamura0",
-	"ohayashi0",
-	"takumasuzuki0",
-	"suzukijun1",
-	"bsaito0",
-	"maifujiwara0",
-	"ikedayoko0",
-	"kimurakenichi0",
-	"kyosuke210",
-	"shota870",
-	"fyamaguchi0",
-	"miki730",
-	"sayurihashimoto0",
-	"naoki460",
-	"satoyumiko0",
-	"minoruhashimoto0",
-	"nanamimurakami0",
-	"mai600",
-	"taro340",
-	"yosuke950",
-	"rokada0",
-	"nanami710",
-	"zishikawa0",
-	"yutawatanabe0",
-	"suzukiosamu0",
-	"mituru130",
-	"taichi000",
-	"chiyoyamamoto0",
-	"yoshidakyosuke0",
-	"vyamazaki0",
-	"wwatanabe0",
-	"ykimura0",
-	"tanakahideki1",
-	"minoruito0",
-	"shotamatsumoto0",
-	"watanabehiroshi0",
-	"taichi560",
-	"nanami090",
-	"akira800",
-	"suzukiyasuhiro0",
-	"momokofukuda0",
-	"kana350",
-	"tanakanaoto0",
-	"akemi800",
-	"tanakakenichi0",
-	"oyoshida0",
-	"yutamatsumoto0",
-	"hiroshisuzuki1",
-	"yamaguchikazuya0",
-	"yoko800",
-	"lnakamura0",
-	"esato1",
-	"atsushitakahashi1",
-	"eshimizu0",
-	"reitanaka1",
-	"yuki500",
-	"tanakashohei2",
-	"akiranishimura0",
-	"naokiyamamoto0",
-	"shimizuatsushi0",
-	"winoue0",
-	"hiroshifujita0",
-	"mikako380",
-	"gotoshohei0",
-	"yumikoyamamoto0",
-	"gmatsuda0",
-	"kumikokobayashi1",
-	"tsubasatakahashi0",
-	"yyamamoto0",
-	"nakamurajun0",
-	"yasuhirokato0",
-	"vsuzuki1",
-	"kobayashihideki0",
-	"murakamiosamu0",
-	"mikako340",
-	"takumaokada0",
-	"osamusato0",
-	"aogawa0",
-	"ikedayosuke0",
-	"sakamotoyoichi0",
-	"yamadakaori1",
-	"ykobayashi1",
-	"fukudananami0",
-	"yasuhirohashimoto0",
-	"akemi670",
-	"rhasegawa0",
-	"naoto740",
-	"satoasuka0",
-	"lyamashita0",
-	"kumiko030",
-	"qikeda0",
-	"ptanaka0",
-	"fmatsuda0",
-	"akiramaeda0",
-	"yoichiyamamoto0",
-	"gsuzuki0",
-	"naokiikeda1",
-	"abekenichi0",
-	"maiyamamoto0",
-	"shimizukumiko0",
-	"zsato0",
-	"manabu050",
-	"shoheinishimura0",
-	"gyoshida0",
-	"chiyo790",
-	"hanakookada0",
-	"xota0",
-	"manabusakamoto0",
-	"jsato0",
-	"kenichi840",
-	"kobayashishota0",
-	"ainoue0",
-	"takuma380",
-	"dikeda0",
-	"dtanaka0",
-	"miturutakahashi0",
-	"fmurakami0",
-	"ishiiakira0",
-	"maayaokamoto0",
-	"asaito1",
-	"atsushi470",
-	"ekobayashi0",
-	"ukobayashi0",
-	"asaito2",
-	"hayashirei0",
-	"suzukisatomi0",
-	"yumiko100",
-	"okadahanako0",
-	"mtanaka0",
-	"hidekiyamamoto0",
-	"yamamotomituru0",
-	"kimuratomoya0",
-	"mikako780",
-	"pgoto0",
-	"harukawatanabe0",
-	"zkimura0",
-	"taichikimura0",
-	"moriminoru0",
-	"thayashi0",
-	"akira740",
-	"suzukiharuka1",
-	"yuta030",
-	"fyamamoto0",
-	"watanaberyosuke0",
-	"maayamatsumoto0",
-	"yoichiendo0",
-	"satokaori0",
-	"gmatsumoto0",
-	"rika250",
-	"jsasaki0",
-	"yutasaito0",
-	"kazuya810",
-	"manabukobayashi0",
-	"hashimotomikako0",
-	"fujiwarahideki0",
-	"yoichi730",
-	"takahashiryosuke0",
-	"tyamaguchi1",
-	"otaminoru0",
-	"momoko990",
-	"kazuyahasegawa0",
-	"mai770",
-	"aishii0",
-	"pokada0",
-	"cyamaguchi0",
-	"akemi500",
-	"jtanaka0",
-	"tnakagawa0",
-	"kondoyoko0",
-	"yoichiogawa0",
-	"hayashikenichi0",
-	"nanami990",
-	"hiroshiendo0",
-	"akirasuzuki0",
-	"maaya140",
-	"itomomoko0",
-	"satorika0",
-	"yoko110",
-	"wyamazaki0",
-	"yoko111",
-	"osato0",
-	"aokitaro0",
-	"gnakamura0",
-	"kobayashiyoko0",
-	"suzukinanami0",
-	"yosukeishikawa0",
-	"manabu450",
-	"naoki630",
-	"kimuranaoki0",
-	"kumiko770",
-	"moriyuta0",
-	"tsubasa300",
-	"hidekinakamura0",
-	"rei080",
-	"shoheiyoshida0",
-	"omatsumoto0",
-	"haruka260",
-	"takuma790",
-	"satoryosuke0",
-	"maedamaaya0",
-	"mikakosasaki0",
-	"vmiura0",
-	"rika570",
-	"myamaguchi0",
-	"minoru110",
-	"ishikawakana0",
-	"yoko300",
-	"tsuzuki0",
-	"kenichiwatanabe0",
-	"naokosakamoto0",
-	"fujitataichi0",
-	"naokigoto0",
-	"yuta210",
-	"sgoto0",
-	"momokoishii0",
-	"yoshidahideki0",
-	"takumainoue0",
-	"suzukiyuta0",
-	"manabu370",
-	"asuka120",
-	"manabu621",
-	"gogawa0",
-	"yamashitaosamu0",
-	"jnakamura1",
-	"atakahashi0",
-	"osamukobayashi0",
-	"satomisato0",
-	"satorika1",
-	"tanakahiroshi1",
-	"satoyuta0",
-	"mai710",
-	"nakamurakaori0",
-	"naoko440",
-	"jokamoto1",
-	"kobayashirei0",
-	"kyosukewatanabe0",
-	"yamaguchijun0",
-	"yoshidahiroshi0",
-	"miurahanako0",
-	"tsubasa790",
-	"hiroshitakahashi0",
-	"yukishimizu0",
-	"inouenaoki0",
-	"yuinakamura0",
-	"hashimotoakemi0",
-	"jwatanabe0",
-	"yosuke890",
-	"mikisato0",
-	"naotoinoue0",
-	"vinoue0",
-	"takuma170",
-	"yamashitatsubasa0",
-	"mituru180",
-	"ttanaka1",
-	"ogawataichi0",
-	"rsakamoto0",
-	"satoakemi0",
-	"lito0",
-	"suzukimaaya1",
-	"nakamurarei0",
-	"momokofujiwara0",
-	"yoko310",
-	"fujiwaramanabu0",
-	"takahashiosamu0",
-	"nakamurakazuya0",
-	"nnakamura0",
-	"akirasuzuki1",
-	"watanabenanami0",
-	"rikaito0",
-	"juntanaka0",
-	"tanakamiki0",
-	"ekato2",
-	"xnishimura0",
-	"ihayashi0",
-	"atsushi921",
-	"mikakoishikawa0",
-	"junmatsuda0",
-	"abejun0",
-	"katoshota0",
-	"shotaishikawa0",
-	"yukikimura0",
-	"xishii0",
-	"rei240",
-	"yutakobayashi0",
-	"kazuya380",
-	"nanamikobayashi0",
-	"zyamada0",
-	"inouehanako0",
-	"yutaota0",
-	"satomikato0",
-	"yoshidayasuhiro0",
-	"akemiikeda0",
-	"yoichikobayashi0",
-	"msuzuki0",
-	"ssato0",
-	"qnakamura0",
-	"ryoheikobayashi0",
-	"naoki880",
-	"sakamotosotaro0",
-	"haruka350",
-	"satonaoki0",
-	"jun430",
-	"sasakimai0",
-	"naoko880",
-	"rikakobayashi1",
-	"nanamikondo0",
-	"yoshidamai1",
-	"nakajimarei0",
-	"morimanabu0",
-	"tanakasayuri0",
-	"momoko040",
-	"kaori580",
-	"haruka100",
-	"akemi600",
-	"miki170",
-	"okamotokyosuke0",
-	"kondonaoto0",
-	"tsubasa610",
-	"ryoheiyamada0",
-	"naoki090",
-	"yamazakimikako0",
-	"minorusato0",
-	"chiyofujii0",
-	"takuma300",
-	"taroyamamoto0",
-	"suzukichiyo0",
-	"wishikawa0",
-	"reinakamura0",
-	"ayamazaki1",
-	"cogawa0",
-	"hasegawamituru0",
-	"cyamaguchi1",
-	"hasegawamomoko0",
-	"suzukishohei0",
-	"qyamazaki0",
-	"kyosuke370",
-	"mgoto0",
-	"yasuhiroogawa0",
-	"maaya250",
-	"kimurayumiko0",
-	"yoko460",
-	"atsushiyamaguchi0",
-	"yamadaasuka0",
-	"wyamaguchi0",
-	"katoyuta0",
-	"yoichi660",
-	"lkato0",
-	"tomoyatakahashi0",
-	"rika370",
-	"inouenaoto0",
-	"kondoshota0",
-	"taro820",
-	"maisasaki0",
-	"gyoshida1",
-	"manabu770",
-	"matsudayoichi0",
-	"nakajimamiki0",
-	"watanabeyoko0",
-	"vwatanabe1",
-	"yamaguchinaoto0",
-	"saitojun0",
-	"naotomori0",
-	"lito1",
-	"ryoheiikeda0",
-	"yuisasaki0",
-	"yishikawa0",
-	"yamazakimituru0",
-	"yumiko050",
-	"okadasayuri0",
-	"skobayashi0",
-	"rika740",
-	"yoko600",
-	"wsato0",
-	"taichi181",
-	"hiroshi800",
-	"yoko420",
-	"naokokondo0",
-	"sakamotorika0",
-	"hiroshiyoshida0",
-	"manabusato0",
-	"rei340",
-	"jsato1",
-	"satomikako0",
-	"murakamihiroshi0",
-	"asukaishii0",
-	"kana550",
-	"fyamaguchi1",
-	"miki190",
-	"dkimura0",
-	"ynakamura0",
-	"endomomoko0",
-	"itoyumiko0",
-	"yamashitayosuke0",
-	"yokokondo0",
-	"tsubasa470",
-	"matsudanaoko0",
-	"miuraatsushi0",
-	"miurataichi0",
-	"manabusato1",
-	"uhasegawa1",
-	"nanamimaeda0",
-	"katotsubasa0",
-	"eyamazaki0",
-	"wyamazaki1",
-	"junyamada0",
-	"akemigoto0",
-	"uokada0",
-	"nishii0",
-	"takumatanaka0",
-	"itomai0",
-	"hidekimaeda0",
-	"osuzuki0",
-	"harukasuzuki0",
-	"watanabeyuta0",
-	"kobayashikaori0",
-	"usuzuki1",
-	"gotokazuya0",
-	"kondotaichi0",
-	"nakamurasatomi0",
-	"ltakahashi0",
-	"jun240",
-	"sayuri860",
-	"jmurakami1",
-	"ftakahashi1",
-	"nanami660",
-	"otaasuka0",
-	"oito0",
-	"satomi720",
-	"ryosuke680",
-	"minoru370",
-	"matsumotokumiko0",
-	"sishii0",
-	"maedanaoko0",
-	"chiyo370",
-	"sasakitakuma0",
-	"reiikeda0",
-	"chiyo540",
-	"yamamotosayuri0",
-	"jota0",
-	"bsasaki0",
-	"bmori0",
-	"itojun0",
-	"atsushikondo0",
-	"jun320",
-	"osamusasaki0",
-	"suzukimaaya2",
-	"shimizuhideki0",
-	"endotomoya0",
-	"yamaguchimanabu0",
-	"rhashimoto0",
-	"rei590",
-	"yosuke490",
-	"tanakaryohei0",
-	"yukinakamura0",
-	"akira580",
-	"minoru400",
-	"yamaguchimomoko0",
-	"hanako410",
-	"hyamamoto0",
-	"maaya910",
-	"sayurikobayashi0",
-	"matsumotonaoko0",
-	"rei250",
-	"momoko980",
-	"asuka370",
-	"asuka100",
-	"yukiito0",
-	"mai500",
-	"manabutanaka0",
-	"taichinakamura0",
-	"csato0",
-	"mikiyoshida0",
-	"fujiiatsushi0",
-	"hayashinaoko0",
-	"kaorikobayashi0",
-	"lfujii0",
-	"wyamaguchi1",
-	"satomifujiwara0",
-	"gyamashita0",
-	"ryohei850",
-	"dnakamura0",
-	"rika040",
-	"satoyuta1",
-	"ynishimura0",
-	"tsubasa240",
-	"yukigoto0",
-	"satomi200",
-	"tsubasashimizu0",
-	"suzukiyumiko0",
-	"nakamurataichi0",
-	"yumiko070",
-	"shotafujiwara0",
-	"maedataro0",
-	"maifujita0",
-	"fujiwarayuki0",
-	"shohei240",
-	"aokirika0",
-	"hanako580",
-	"rgoto0",
-	"yuta100",
-	"yosukeishikawa1",
-	"dokada0",
-	"kimurahanako0",
-	"wnakagawa0",
-	"yukiyoshida0",
-	"naokitanaka0",
-	"ysaito0",
-	"miturusato0",
-	"naoki870",
-	"chiyo310",
-	"naokitanaka1",
-	"chiyonakamura0",
-	"msaito0",
-	"jsuzuki1",
-	"suzukihanako0",
-	"dokada1",
-	"rei850",
-	"kenichihashimoto0",
-	"fnakamura0",
-	"hasegawatakuma0",
-	"lyamamoto0",
-	"takuma600",
-	"manabutakahashi0",
-	"ryosukesakamoto0",
-	"itoharuka0",
-	"satomi130",
-	"tomoya450",
+// dnsNames はDNSで応答するサブドメインの集合です。
+// 集合が変わるたびにSOAのシリアルを進め、IXFRのために差分を記録する。
+// クエリごとの参照でロックを取り合わないよう、集合は変更のたびに作り直したスナップショットを atomic に差し替える。
+// 登録よりクエリの方が圧倒的に多いので、変更時に全体をコピーする方が安い。
+type dnsNames struct {
+	set atomic.Pointer[dnsNameSet]
+
+	// mu は変更と差分の記録を守ります
+	mu      sync.Mutex
+	journal []dnsJournalEntry
+
+	// onChange は集合が変わったときに新しいシリアルで呼ばれます。ロックを取ったまま呼ばれるので重い処理はしないこと。
+	onChange func(serial uint32)
+	// records は差分を記録するときに、名前から合成されるレコードを求めるために呼ばれます。
+	// 削除した名前は後から合成できないので、変更した時点のレコードを差分に残す。
+	records func(name string) []dns.RR
+	// persistSerial は serial までのシリアルを使うことを保存します。nilなら保存しない。
+	persistSerial func(serial uint32) error
+	// serialLimit は保存済みのシリアルで、これを超えるときにまた先の分まで保存する
+	serialLimit uint32
+}
+
+// dnsNameSet はある時点の集合で、作成後は変更しない。
+// 名前はハッシュ値の順に並べ、ハッシュ値の上位ビットで引く索引から候補の範囲を求めて文字列を確かめる。
+// ハッシュ値は一様に分布するので範囲は数件で済み、mapよりも1件あたりのメモリが小さい。
+type dnsNameSet struct {
+	serial uint32
+	// hashes は names の各要素のハッシュ値で、昇順に並んでいる
+	hashes []uint64
+	names  []string
+	// index[b] はハッシュ値の上位 indexBits ビットが b 以上になる最初の位置です
+	index     []uint32
+	indexBits uint
+	// filter はランダムなサブドメインへの問い合わせを二分探索の前に弾くためのものです
+	filter *isuutil.BloomFilter
+	// filterSize は filter を作ったときの要素数で、これより大きく増えたら誤検出率を保つため作り直す
+	filterSize int
 }
 
-var userNames = map[string]bool{}
-var userNameLock sync.RWMutex
+// ブルームフィルタの誤検出率。誤検出しても二分探索で確認するので、正しさには影響しない。
+const dnsNamesFalsePositiveRate = 0.01
 
-// panic時にプロセスを終了させずにログ出力するハンドラー
-func handlePanic(w dns.ResponseWriter, r *dns.Msg) {
-	if rcv := recover(); rcv != nil {
-		//log.Println("[ERR] panic", rcv, w, r)
+// newDNSNameSet は重複のない names から集合を作ります
+func newDNSNameSet(serial uint32, names []string) *dnsNameSet {
+	s := &dnsNameSet{
+		serial:     serial,
+		hashes:     make([]uint64, len(names)),
+		names:      slices.Clone(names),
+		filter:     isuutil.NewBloomFilter(names, dnsNamesFalsePositiveRate),
+		filterSize: len(names),
 	}
+	for i, name := range s.names {
+		s.hashes[i] = xxhash.Sum64String(name)
+	}
+	sort.Sort(s)
+	s.buildIndex()
+	return s
 }
 
-// クエリで指定されたサブドメインをレコードとして応答（エコー機能）するクエリハンドラー
-func echoHandler(w dns.ResponseWriter, r *dns.Msg) {
-	defer handlePanic(w, r)
+// buildIndex は平均して4件ごとに区切る索引を作ります
+func (s *dnsNameSet) buildIndex() {
+	s.indexBits = uint(bits.Len(uint(len(s.hashes) / 4)))
+	s.index = make([]uint32, 1<<s.indexBits+1)
+	i := 0
+	for b := range s.index {
+		for i < len(s.hashes) && s.hashes[i]>>(64-s.indexBits) < uint64(b) {
+			i++
+		}
+		s.index[b] = uint32(i)
+	}
+}
 
-	// 関数終了時にDNS応答
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Compress = false
-	defer w.WriteMsg(m)
+func (s *dnsNameSet) Len() int { return len(s.names) }
+func (s *dnsNameSet) Less(i, j int) bool {
+	return s.hashes[i] < s.hashes[j] || (s.hashes[i] == s.hashes[j] && s.names[i] < s.names[j])
+}
+func (s *dnsNameSet) Swap(i, j int) {
+	s.hashes[i], s.hashes[j] = s.hashes[j], s.hashes[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
 
-	for _, q := range r.Question {
-		// サブドメイン部分のみ取り出して、レスポンスのリソースデータとして扱う
-		dataLen := len(q.Name) - len(domain) - 2
-		subDomain := ""
-		if dataLen < -1 {
-			continue
+// with は s に added を加えた集合を作ります。added は s に含まれていないこと。
+// 登録のたびに呼ばれるので、全体をソートし直したりフィルタを作り直したりはしない。
+func (s *dnsNameSet) with(serial uint32, added []string) *dnsNameSet {
+	if len(s.names)+len(added) > 2*max(s.filterSize, 1024) {
+		return newDNSNameSet(serial, append(slices.Clone(s.names), added...))
+	}
+
+	a := newDNSNameSet(serial, added)
+	merged := &dnsNameSet{
+		serial:     serial,
+		hashes:     make([]uint64, 0, len(s.names)+len(added)),
+		names:      make([]string, 0, len(s.names)+len(added)),
+		filter:     s.filter.Clone(),
+		filterSize: s.filterSize,
+	}
+	i, j := 0, 0
+	for i < len(s.names) && j < len(a.names) {
+		if s.hashes[i] < a.hashes[j] || (s.hashes[i] == a.hashes[j] && s.names[i] < a.names[j]) {
+			merged.hashes = append(merged.hashes, s.hashes[i])
+			merged.names = append(merged.names, s.names[i])
+			i++
+		} else {
+			merged.hashes = append(merged.hashes, a.hashes[j])
+			merged.names = append(merged.names, a.names[j])
+			j++
 		}
-		if dataLen >= 0 {
-			subDomain = q.Name[:dataLen]
+	}
+	merged.hashes = append(append(merged.hashes, s.hashes[i:]...), a.hashes[j:]...)
+	merged.names = append(append(merged.names, s.names[i:]...), a.names[j:]...)
+	for _, h := range a.hashes {
+		merged.filter.AddHash(h)
+	}
+	merged.buildIndex()
+	return merged
+}
+
+func (s *dnsNameSet) has(name string) bool {
+	h := xxhash.Sum64String(name)
+	if !s.filter.MayContainHash(h) {
+		return false
+	}
+	b := h >> (64 - s.indexBits)
+	for i := s.index[b]; i < s.index[b+1] && s.hashes[i] <= h; i++ {
+		if s.hashes[i] == h && s.names[i] == name {
+			return true
 		}
+	}
+	return false
+}
 
-		// この時点で応答できるかは未定だが、応答しようとしている内容をログ出力
-		//log.Printf("[INFO] query: name=%s class=%s type=%s\n",
-		//	subDomain, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+// dnsJournalEntry はシリアルが From から To に進んだときの差分です。
+// AddedRecords と RemovedRecords は変更した時点で合成したレコードで、IXFRではこれを送る。
+type dnsJournalEntry struct {
+	From    uint32
+	To      uint32
+	Added   []string
+	Removed []string
 
-		// レスポンスの共通ヘッダー
-		// クエリの内容をそのまま使用し、TTLは0固定でキャッシュさせない
-		rr_header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: 300}
-		rr_header_nx := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: 0}
+	AddedRecords   []dns.RR
+	RemovedRecords []dns.RR
+}
 
-		// NewRRやNewZoneParserを使うとほとんどあらゆるレコードに対応可能になるが、
-		// 同時にCNAMEによるSubdomain Takeoverなどリスクを負うことになるので必要なものだけ追加する
-		switch q.Qclass {
-		case dns.ClassINET:
-			switch q.Qtype {
-			case dns.TypeA:
-				ip, err := getIp(subDomain)
-				if err != nil {
-					m.Answer = append(m.Answer, &dns.A{
-						Hdr: rr_header_nx,
-					})
-					m.Rcode = dns.RcodeNameError
-					err2 := w.WriteMsg(m)
-					if !errors.Is(err, ErrNotFound) {
-						//log.Printf("[ERR] DNS Resolution %+v\n", err)
-					}
-					if err2 != nil {
-						//log.Printf("[ERR] %s\n", err2.Error())
-					}
-					continue
-				}
-				m.Answer = append(m.Answer, &dns.A{
-					Hdr: rr_header,
-					A:   net.ParseIP(ip),
-				})
-			case dns.TypeNS:
-				if subDomain == "" {
-					m.Answer = append(m.Answer, &dns.NS{
-						Hdr: rr_header,
-						Ns:  "ns1." + domain + ".",
-					})
-				} else {
-					m.Answer = append(m.Answer, &dns.NS{
-						Hdr: rr_header_nx,
-					})
-					m.Rcode = dns.RcodeNameError
-				}
-			case dns.TypeSOA:
-				if subDomain == "" {
-					m.Answer = append(m.Answer, &dns.SOA{
-						Hdr:     rr_header,
-						Ns:      "ns1." + domain + ".",
-						Mbox:    "hostmaster." + domain + ".",
-						Serial:  0,
-						Refresh: 10800,
-						Retry:   3600,
-						Expire:  604800,
-						Minttl:  3600,
-					})
-				} else {
-					m.Answer = append(m.Answer, &dns.SOA{
-						Hdr: rr_header_nx,
-					})
-					m.Rcode = dns.RcodeNameError
-				}
-			}
+// IXFRで差分を返せる最大の変更回数。これより古いシリアルからの要求にはAXFRで答える。
+const maxDNSJournalEntries = 1024
+
+// dnsSerialReserve はシリアルを保存するときに先に確保しておく数です。
+// 変更のたびに保存せずに済むよう、保存した値までは保存し直さずに使う。
+const dnsSerialReserve = 1000
+
+func newDNSNames() *dnsNames {
+	n := &dnsNames{}
+	// 保存したシリアルが無ければ時刻から始める。
+	// 1秒に1回より多く変更されると時刻を追い越すので、巻き戻らないようにするには RestoreSerial で保存先を設定すること。
+	n.set.Store(newDNSNameSet(uint32(time.Now().Unix()), nil))
+	return n
+}
+
+// RestoreSerial は前回までに保存した persisted より後からシリアルを始め、以後は persist で保存します。
+// 起動時に、名前を加える前に呼ぶこと。
+func (n *dnsNames) RestoreSerial(persisted uint32, persist func(serial uint32) error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	set := *n.set.Load()
+	if serialAfter(persisted+1, set.serial) {
+		set.serial = persisted + 1
+	}
+	n.set.Store(&set)
+	n.persistSerial = persist
+	n.serialLimit = persisted
+	return n.reserveSerial(set.serial)
+}
+
+// reserveSerial は serial が保存済みの範囲を超えるなら、先の分までまとめて保存します。n.mu を取った状態で呼ぶこと。
+func (n *dnsNames) reserveSerial(serial uint32) error {
+	if n.persistSerial == nil || !serialAfter(serial, n.serialLimit) {
+		return nil
+	}
+	limit := serial + dnsSerialReserve
+	if err := n.persistSerial(limit); err != nil {
+		return err
+	}
+	n.serialLimit = limit
+	return nil
+}
+
+// serialAfter は RFC 1982 のシリアル番号算術で a が b より後かどうかを返します
+func serialAfter(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// Has はロックを取らずに name が集合に含まれるかを返します
+func (n *dnsNames) Has(name string) bool {
+	return n.set.Load().has(name)
+}
+
+// Len は集合の要素数を返します
+func (n *dnsNames) Len() int {
+	return len(n.set.Load().names)
+}
+
+// Serial はゾーンの現在のSOAシリアルを返します
+func (n *dnsNames) Serial() uint32 {
+	return n.set.Load().serial
+}
+
+// Snapshot は現在のシリアルとソート済みの名前の一覧を返します
+func (n *dnsNames) Snapshot() (uint32, []string) {
+	set := n.set.Load()
+	names := slices.Clone(set.names)
+	slices.Sort(names)
+	return set.serial, names
+}
+
+// Changes は since から現在までの差分を返します。
+// 記録が残っていない場合は false を返す。
+func (n *dnsNames) Changes(since uint32) ([]dnsJournalEntry, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if since == n.set.Load().serial {
+		return nil, true
+	}
+	for i, entry := range n.journal {
+		if entry.From == since {
+			return slices.Clone(n.journal[i:]), true
 		}
 	}
-	err := w.WriteMsg(m)
-	if err != nil {
+	return nil, false
+}
+
+func (n *dnsNames) Add(names ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cur := n.set.Load()
+	var added []string
+	for _, name := range names {
+		if !cur.has(name) {
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	slices.Sort(added)
+	added = slices.Compact(added)
+	n.bumpSerial(cur.with(cur.serial+1, added), added, nil)
+}
+
+// Reset は集合を names で置き換えます
+func (n *dnsNames) Reset(names []string) {
+	names = slices.Clone(names)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cur := n.set.Load()
+	var added, removed []string
+	for _, name := range names {
+		if !cur.has(name) {
+			added = append(added, name)
+		}
+	}
+	for _, name := range cur.names {
+		if _, ok := slices.BinarySearch(names, name); !ok {
+			removed = append(removed, name)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		n.bumpSerial(newDNSNameSet(cur.serial+1, names), added, removed)
+	}
+}
+
+// Invalidate は集合を変えずにシリアルだけ進めます。
+// 名前に対応するアドレスが変わったときに使い、差分では表せないので記録を捨ててセカンダリにAXFRさせる。
+func (n *dnsNames) Invalidate() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cur := n.set.Load()
+	n.journal = nil
+	set := *cur
+	set.serial++
+	// 保存に失敗しても応答は止めず、次の変更でまた保存を試みる
+	_ = n.reserveSerial(set.serial)
+	n.set.Store(&set)
+	if n.onChange != nil {
+		n.onChange(cur.serial + 1)
+	}
+}
+
+// bumpSerial は set を新しい集合にしてシリアルを進めます。n.mu を取った状態で呼ぶこと。
+func (n *dnsNames) bumpSerial(set *dnsNameSet, added []string, removed []string) {
+	// シリアルはRFC 1982のシリアル番号算術で比較されるので、オーバーフローしても問題ない
+	entry := dnsJournalEntry{From: n.set.Load().serial, To: set.serial, Added: added, Removed: removed}
+	if n.records != nil {
+		for _, name := range removed {
+			entry.RemovedRecords = append(entry.RemovedRecords, n.records(name)...)
+		}
+		for _, name := range added {
+			entry.AddedRecords = append(entry.AddedRecords, n.records(name)...)
+		}
+	}
+	// 保存に失敗しても応答は止めず、次の変更でまた保存を試みる
+	_ = n.reserveSerial(set.serial)
+	n.set.Store(set)
+	n.journal = append(n.journal, entry)
+	if len(n.journal) > maxDNSJournalEntries {
+		n.journal = slices.Delete(n.journal, 0, len(n.journal)-maxDNSJournalEntries)
+	}
+	if n.onChange != nil {
+		n.onChange(entry.To)
+	}
+}
+
+var userNames = newDNSNames()
+
+const (
+	// EDNS0で受け付けるUDPペイロードサイズの上限。フラグメントを避けるため DNS Flag Day 2020 の推奨値にする。
+	maxUDPPayloadSize = 1232
+	ednsVersion       = 0
+)
+
+// クエリで指定されたサブドメインをレコードとして応答（エコー機能）するクエリハンドラー。
+// 1つのクエリに対して必ず1回だけ応答を書き込む。
+func echoHandler(w dns.ResponseWriter, r *dns.Msg) {
+	if isZoneTransfer(r) {
+		transferHandler(w, r)
+		return
+	}
+
+	m := buildReply(r)
+
+	// UDPでは問い合わせ側のバッファに収まるように切り詰め、TCを立ててTCPで再送させる
+	size := dns.MaxMsgSize
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size = dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(min(max(opt.UDPSize(), dns.MinMsgSize), maxUDPPayloadSize))
+		}
+	}
+	m.Truncate(size)
+
+	if err := w.WriteMsg(m); err != nil {
 		//log.Printf("[ERR] %s", err.Error())
 	}
 }
 
+// servFailOnPanic はpanicした場合にプロセスを終了させず、*m をSERVFAILの応答にします。deferで呼ぶこと。
+func servFailOnPanic(r *dns.Msg, m **dns.Msg) {
+	if rcv := recover(); rcv != nil {
+		//log.Println("[ERR] panic", rcv, r)
+		*m = new(dns.Msg)
+		(*m).SetRcode(r, dns.RcodeServerFailure)
+		setEdns0(*m, r)
+	}
+}
+
+// buildReply は r に対する応答を組み立てます。
+// panicした場合はプロセスを終了させずにSERVFAILを返す。
+func buildReply(r *dns.Msg) (m *dns.Msg) {
+	defer servFailOnPanic(r, &m)
+
+	m = new(dns.Msg)
+	m.SetReply(r)
+	m.Compress = false
+
+	if r.Opcode != dns.OpcodeQuery {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		return m
+	}
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		return m
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != ednsVersion {
+		m.SetRcode(r, dns.RcodeBadVers)
+		setEdns0(m, r)
+		return m
+	}
+	setEdns0(m, r)
+
+	q := r.Question[0]
+	zone, subDomain, ok := findZone(q.Name)
+	if !ok || q.Qclass != dns.ClassINET {
+		// 権威を持たない名前には答えない
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+
+	// この時点で応答できるかは未定だが、応答しようとしている内容をログ出力
+	//log.Printf("[INFO] query: name=%s class=%s type=%s\n",
+	//	subDomain, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+
+	m.Authoritative = true
+	answerQuestion(m, zone, q, subDomain)
+
+	return m
+}
+
+// setEdns0 は問い合わせにOPTレコードがあれば応答にも付けます
+func setEdns0(m *dns.Msg, r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	// 拡張RCODEの上位ビットはPack時にOPTへ入れられる
+	m.SetEdns0(maxUDPPayloadSize, opt.Do())
+}
+
 // 指定ネットワークでDNSサーバー処理を実行
 func serveDNS(server *dns.Server) {
 	if err := server.ListenAndServe(); err != nil {
@@ -1405,14 +436,12 @@ func serveDNS(server *dns.Server) {
 	}
 }
 
-func getIp(subDomain string) (string, error) {
+func (z *hostedZone) getIp(subDomain string) (string, error) {
 	if subDomain == "" {
-		return powerDNSSubdomainAddress, nil
+		return z.address(), nil
 	}
-	userNameLock.RLock()
-	defer userNameLock.RUnlock()
-	if _, ok := userNames[subDomain]; ok {
-		return powerDNSSubdomainAddress, nil
+	if z.names.Has(subDomain) {
+		return z.userAddress(subDomain), nil
 	}
 
 	//var i int
@@ -1430,26 +459,52 @@ func getIp(subDomain string) (string, error) {
 	return "", ErrNotFound
 }
 
+// initializeDnsCache はゾーンファイルとユーザ名を読み込み直します。
+// dbOnly ならゾーンファイルは読み込み済みのものを使う。
 func initializeDnsCache(dbOnly bool) error {
-	// initialize は同時に呼ばれないので thread-safe ではなくて良い
-	userNameLock.Lock()
-	defer userNameLock.Unlock()
-	userNames = map[string]bool{}
-	if !dbOnly {
-		for _, subdomain := range initialSubdomains {
-			userNames[subdomain] = true
+	start := time.Now()
+
+	for _, zone := range hostedZones {
+		if !dbOnly || zone.file.Load() == nil {
+			if _, err := zone.loadFile(); err != nil {
+				return err
+			}
+		}
+		if zone.names != userNames {
+			if err := zone.reloadNames(context.Background()); err != nil {
+				return err
+			}
 		}
 	}
 
 	var names []string
-	err := dbConn.Select(&names, "SELECT name FROM users")
+	if zone := primaryZone(); zone != nil {
+		names = append(names, zone.file.Load().Subdomains...)
+	}
+
+	var users []struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+	err := dbConn.Select(&users, "SELECT id, name FROM users ORDER BY id")
 	if err != nil {
 		return fmt.Errorf("failed to select users: %w", err)
 	}
 
-	for _, name := range names {
-		userNames[name] = true
+	var lastUserID int64
+	userIDs := make(map[string]int64, len(users))
+	for _, user := range users {
+		names = append(names, user.Name)
+		userIDs[user.Name] = user.ID
+		lastUserID = user.ID
 	}
+	// 名前が増えてシリアルが進む前にアドレスを引けるようにしておく。
+	// 消える名前も差分にアドレスを記録するまでは残し、置き換えるのは後にする。
+	userShards.AddUserIDs(userIDs)
+	userNames.Reset(names)
+	userShards.ResetUserIDs(userIDs)
+	dnsSync.setPolled(lastUserID, int64(len(users)))
+	dnsMetrics.observeInitialize(time.Since(start))
 
 	return nil
 }
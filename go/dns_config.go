@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/isuutil"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+// DNSサーバーの設定。
+// 何も指定しなければ従来どおり u.isucon.dev を :53 で待ち受け、usersテーブルの名前に応答する。
+// ISUCON13_DNS_CONFIG にJSONファイルを指定すると、本番のゾーンの隣にステージング用のゾーンを置くなど複数のゾーンを扱える。
+//
+//	{
+//	  "listen": [":53"],
+//	  "zones": [
+//	    {"name": "u.isucon.dev", "zone_file": "../pdns/u.isucon.dev.zone", "names": "users"},
+//	    {"name": "stg.isucon.dev", "names": "mysql:isucon:isucon@tcp(192.168.0.14:3306)/isupipe",
+//	     "user_ttl": 60, "soa": {"refresh": 600, "minimum": 60}}
+//	  ]
+//	}
+//
+// 最初のゾーンが本番のゾーンで、登録APIやノード間の同期、シャードによる振り分け、Cookieのドメインはこのゾーンに対して行う。
+const (
+	dnsConfigEnvKey   = "ISUCON13_DNS_CONFIG"
+	dnsZoneEnvKey     = "ISUCON13_DNS_ZONE"
+	dnsZoneFileEnvKey = "ISUCON13_DNS_ZONE_FILE"
+	dnsListenEnvKey   = "ISUCON13_DNS_LISTEN"
+
+	defaultDNSZone   = "u.isucon.dev"
+	defaultDNSListen = ":53"
+
+	// dnsNamesFromUsers はusersテーブルの名前に応答する
+	dnsNamesFromUsers = "users"
+	// dnsNamesFromMySQL は "mysql:DSN" の形式で、別のDBのusersテーブルの名前に応答する
+	dnsNamesFromMySQL = "mysql:"
+	// dnsNamesNone はゾーンファイルの名前にだけ応答する
+	dnsNamesNone = "none"
+)
+
+type dnsConfig struct {
+	Listen []string        `json:"listen"`
+	Zones  []dnsZoneConfig `json:"zones"`
+}
+
+type dnsZoneConfig struct {
+	Name string `json:"name"`
+	// ZoneFile を省略すると ../pdns/<name>.zone を読む
+	ZoneFile string `json:"zone_file"`
+	// Names はユーザ名の出どころで、"users"、"mysql:DSN"、"none" のいずれか
+	Names string `json:"names"`
+	// Address はゾーンファイルの <ISUCON_SUBDOMAIN_ADDRESS> とユーザ名のAレコードに使うアドレスです。
+	// 省略すると ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS を使う。
+	Address string `json:"address"`
+	// UserTTL はユーザ名から合成するレコードのTTLです
+	UserTTL uint32 `json:"user_ttl"`
+	// SOA はゾーンファイルのSOAのタイマーを上書きします
+	SOA dnsSOAConfig `json:"soa"`
+	// Notify はNOTIFYを送るセカンダリです。最初のゾーンでは省略すると ISUCON13_DNS_NOTIFY を使う。
+	Notify []string `json:"notify"`
+}
+
+// dnsSOAConfig の0の項目はゾーンファイルの値のままにする
+type dnsSOAConfig struct {
+	TTL     uint32 `json:"ttl"`
+	Refresh uint32 `json:"refresh"`
+	Retry   uint32 `json:"retry"`
+	Expire  uint32 `json:"expire"`
+	Minimum uint32 `json:"minimum"`
+}
+
+var (
+	dnsListenAddrs = []string{defaultDNSListen}
+	// hostedZones は応答するゾーンで、先頭が本番のゾーンです
+	hostedZones []*hostedZone
+)
+
+// loadDNSConfig は設定を読み込んで hostedZones と dnsListenAddrs を置き換えます。
+// 本番のゾーンのユーザ名には userNames を使う。
+func loadDNSConfig() error {
+	config := dnsConfig{}
+	if path := os.Getenv(dnsConfigEnvKey); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read dns config: %w", err)
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("failed to parse dns config: %w", err)
+		}
+	}
+	if len(config.Zones) == 0 {
+		config.Zones = []dnsZoneConfig{{Name: defaultDNSZone, Names: dnsNamesFromUsers}}
+	}
+	if v, ok := os.LookupEnv(dnsZoneEnvKey); ok {
+		config.Zones[0].Name = v
+	}
+	if v, ok := os.LookupEnv(dnsZoneFileEnvKey); ok {
+		config.Zones[0].ZoneFile = v
+	}
+	if v, ok := os.LookupEnv(dnsListenEnvKey); ok {
+		config.Listen = strings.Split(v, ",")
+	}
+	if len(config.Listen) == 0 {
+		config.Listen = []string{defaultDNSListen}
+	}
+
+	zones := make([]*hostedZone, 0, len(config.Zones))
+	seen := map[string]bool{}
+	for i, zc := range config.Zones {
+		if i == 0 && zc.Names != "" && zc.Names != dnsNamesFromUsers {
+			return fmt.Errorf("the first zone %s must take names from %q", zc.Name, dnsNamesFromUsers)
+		}
+		z, err := newHostedZone(zc, i == 0)
+		if err != nil {
+			return err
+		}
+		if seen[z.origin] {
+			return fmt.Errorf("zone %s is configured twice", z.origin)
+		}
+		seen[z.origin] = true
+		zones = append(zones, z)
+	}
+
+	hostedZones = zones
+	domain = strings.TrimSuffix(zones[0].origin, ".")
+	dnsListenAddrs = config.Listen
+	return nil
+}
+
+// hostedZone は応答する1つのゾーンです
+type hostedZone struct {
+	config dnsZoneConfig
+	// origin は小文字のFQDNです
+	origin string
+	file   atomic.Pointer[zoneFile]
+	names  *dnsNames
+	// source は本番以外のゾーンでユーザ名を読むDBです。usersテーブルを読む場合は dbConn を使うので nil のまま。
+	source *sqlx.DB
+	// routes は本番のゾーンでユーザをシャードのノードに振り分けるためのものです
+	routes *dnsShardRouter
+}
+
+// newHostedZone は config のゾーンを作ります。
+// 本番のゾーン (primary) のユーザ名は userNames で、登録APIとノード間の同期で更新される。
+func newHostedZone(config dnsZoneConfig, primary bool) (*hostedZone, error) {
+	if _, ok := dns.IsDomainName(config.Name); !ok || config.Name == "" {
+		return nil, fmt.Errorf("invalid zone name: %q", config.Name)
+	}
+	z := &hostedZone{
+		config: config,
+		origin: strings.ToLower(dns.Fqdn(config.Name)),
+		names:  newDNSNames(),
+	}
+	if z.config.ZoneFile == "" {
+		z.config.ZoneFile = "../pdns/" + strings.TrimSuffix(z.origin, ".") + ".zone"
+	}
+	if z.config.UserTTL == 0 {
+		z.config.UserTTL = userRecordTTL
+	}
+
+	switch {
+	case primary:
+		z.names = userNames
+		z.routes = userShards
+	case config.Names == dnsNamesFromUsers:
+		// 本番と同じDBを読むが、登録の伝搬は行わずポーリングだけで追いつく
+	case strings.HasPrefix(config.Names, dnsNamesFromMySQL):
+		db, err := isuutil.NewIsuconDBFromDSN(strings.TrimPrefix(config.Names, dnsNamesFromMySQL))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to names source of %s: %w", z.origin, err)
+		}
+		z.source = db
+	case config.Names == "" || config.Names == dnsNamesNone:
+	default:
+		return nil, fmt.Errorf("unknown names source of %s: %q", z.origin, config.Names)
+	}
+	z.names.records = func(name string) []dns.RR {
+		return userRecords(z, name)
+	}
+	return z, nil
+}
+
+// userAddress はユーザ名のAレコードのアドレスです。名前が集合にあるかは確かめない。
+func (z *hostedZone) userAddress(subDomain string) string {
+	if z.routes != nil {
+		return z.routes.Address(subDomain)
+	}
+	return z.address()
+}
+
+// address はゾーンのapexとユーザ名に使うアドレスです
+func (z *hostedZone) address() string {
+	if z.config.Address != "" {
+		return z.config.Address
+	}
+	return powerDNSSubdomainAddress
+}
+
+// loadFile はゾーンファイルを読み込み直します
+func (z *hostedZone) loadFile() (*zoneFile, error) {
+	zf, err := loadZoneFile(z.config.ZoneFile, z.origin, z.address())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load zone %s: %w", z.origin, err)
+	}
+	z.setFile(zf)
+	return zf, nil
+}
+
+// setFile はSOAのタイマーを設定で上書きしてからゾーンファイルを差し替えます
+func (z *hostedZone) setFile(zf *zoneFile) {
+	soa := z.config.SOA
+	if soa.TTL != 0 {
+		zf.SOA.Hdr.Ttl = soa.TTL
+	}
+	if soa.Refresh != 0 {
+		zf.SOA.Refresh = soa.Refresh
+	}
+	if soa.Retry != 0 {
+		zf.SOA.Retry = soa.Retry
+	}
+	if soa.Expire != 0 {
+		zf.SOA.Expire = soa.Expire
+	}
+	if soa.Minimum != 0 {
+		zf.SOA.Minttl = soa.Minimum
+	}
+	z.file.Store(zf)
+}
+
+// reloadNames は本番以外のゾーンのユーザ名を読み込み直します
+func (z *hostedZone) reloadNames(ctx context.Context) error {
+	zf := z.file.Load()
+	if zf == nil {
+		return nil
+	}
+	names := append([]string{}, zf.Subdomains...)
+	if db := z.db(); db != nil {
+		var users []string
+		if err := db.SelectContext(ctx, &users, "SELECT name FROM users"); err != nil {
+			return fmt.Errorf("failed to select users of %s: %w", z.origin, err)
+		}
+		names = append(names, users...)
+	}
+	z.names.Reset(names)
+	return nil
+}
+
+// db は本番以外のゾーンでユーザ名を読むDBを返します。nilならゾーンファイルの名前だけに応答する。
+func (z *hostedZone) db() *sqlx.DB {
+	if z.routes == nil && z.config.Names == dnsNamesFromUsers {
+		return dbConn
+	}
+	return z.source
+}
+
+// RunPoller は interval ごとに本番以外のゾーンのユーザ名を読み込み直します。
+// goroutineで動かすことが想定されています。
+func (z *hostedZone) RunPoller(interval time.Duration, logger echo.Logger) {
+	if z.db() == nil || interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := z.reloadNames(context.Background()); err != nil {
+			logger.Warnf("failed to reload dns names: %v", err)
+		}
+	}
+}
+
+// split は name からこのゾーンに対するサブドメイン部分を取り出します。
+// apexなら空文字列を、ゾーン外なら false を返す。
+func (z *hostedZone) split(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if name == z.origin {
+		return "", true
+	}
+	if !strings.HasSuffix(name, "."+z.origin) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+z.origin), true
+}
+
+func (z *hostedZone) fqdnOf(subDomain string) string {
+	return subDomain + "." + z.origin
+}
+
+// primaryZone は本番のゾーンを返します
+func primaryZone() *hostedZone {
+	if len(hostedZones) == 0 {
+		return nil
+	}
+	return hostedZones[0]
+}
+
+// findZone は name を含むゾーンとサブドメイン部分を返します。
+// ゾーンが入れ子になっている場合はより深いものを選ぶ。
+func findZone(name string) (*hostedZone, string, bool) {
+	var found *hostedZone
+	var subDomain string
+	for _, z := range hostedZones {
+		if sub, ok := z.split(name); ok && (found == nil || len(z.origin) > len(found.origin)) {
+			found, subDomain = z, sub
+		}
+	}
+	return found, subDomain, found != nil
+}
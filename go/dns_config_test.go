@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testStagingZone = `$TTL 3600
+@   SOA  ns1 hostmaster.stg.isucon.dev. 0 10800 3600 604800 3600
+@        0 IN NS  ns1.stg.isucon.dev.
+ns1      0 IN A   192.0.2.101
+www      0 IN A   192.0.2.101
+`
+
+func TestLoadDNSConfig(t *testing.T) {
+	prevZones, prevDomain, prevListen := hostedZones, domain, dnsListenAddrs
+	t.Cleanup(func() {
+		hostedZones, domain, dnsListenAddrs = prevZones, prevDomain, prevListen
+	})
+
+	path := filepath.Join(t.TempDir(), "dns.json")
+	config := `{
+	"listen": [":53", "127.0.0.1:5353"],
+	"zones": [
+		{"name": "u.isucon.dev"},
+		{"name": "STG.isucon.dev", "names": "none", "zone_file": "stg.zone", "user_ttl": 60, "soa": {"refresh": 600}}
+	]
+}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	t.Setenv(dnsConfigEnvKey, path)
+	t.Setenv(dnsZoneEnvKey, "prod.isucon.dev")
+
+	if err := loadDNSConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if domain != "prod.isucon.dev" || len(hostedZones) != 2 || hostedZones[0].names != userNames {
+		t.Errorf("the first zone must be the primary zone overridden by env: %s", domain)
+	}
+	if strings.Join(dnsListenAddrs, ",") != ":53,127.0.0.1:5353" {
+		t.Errorf("unexpected listen addresses: %v", dnsListenAddrs)
+	}
+	stg := hostedZones[1]
+	if stg.origin != "stg.isucon.dev." || stg.config.ZoneFile != "stg.zone" || stg.config.UserTTL != 60 {
+		t.Errorf("unexpected staging zone: %+v", stg.config)
+	}
+
+	// 本番のゾーンは usersテーブル以外を指定できない
+	if err := os.WriteFile(path, []byte(`{"zones": [{"name": "u.isucon.dev", "names": "none"}]}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err := loadDNSConfig(); err == nil {
+		t.Errorf("the primary zone must take names from users")
+	}
+}
+
+func TestEchoHandler_MultiZone(t *testing.T) {
+	setupTestZone(t, testZone)
+
+	zf, err := parseZone([]byte(testStagingZone), "stg.isucon.dev", "test")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+	stg, err := newHostedZone(dnsZoneConfig{Name: "stg.isucon.dev", Address: "192.0.2.101", UserTTL: 60, SOA: dnsSOAConfig{Minimum: 30}}, false)
+	if err != nil {
+		t.Fatalf("failed to create zone: %v", err)
+	}
+	stg.setFile(zf)
+	stg.names.Add("bob")
+	hostedZones = append(hostedZones, stg)
+	udpAddr, _ := serveTestDNS(t)
+
+	tests := []struct {
+		qname string
+		rcode int
+		addr  string
+		ttl   uint32
+	}{
+		{qname: "alice.u.isucon.dev.", rcode: dns.RcodeSuccess, addr: "192.0.2.1", ttl: userRecordTTL},
+		{qname: "bob.stg.isucon.dev.", rcode: dns.RcodeSuccess, addr: "192.0.2.101", ttl: 60},
+		{qname: "www.stg.isucon.dev.", rcode: dns.RcodeSuccess, addr: "192.0.2.101", ttl: 0},
+		// ユーザ名はゾーンごとに別の集合になる
+		{qname: "alice.stg.isucon.dev.", rcode: dns.RcodeNameError},
+		{qname: "bob.u.isucon.dev.", rcode: dns.RcodeNameError},
+		{qname: "www.other.isucon.dev.", rcode: dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tt.qname, dns.TypeA)
+		r := exchange(t, "udp", udpAddr, m)
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: want rcode %s, got %s", tt.qname, dns.RcodeToString[tt.rcode], dns.RcodeToString[r.Rcode])
+			continue
+		}
+		if tt.addr == "" {
+			continue
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != tt.addr || r.Answer[0].Header().Ttl != tt.ttl {
+			t.Errorf("%s: want %s with ttl %d, got %v", tt.qname, tt.addr, tt.ttl, r.Answer)
+		}
+	}
+
+	// SOAのタイマーは設定で上書きされる
+	m := new(dns.Msg)
+	m.SetQuestion("nobody.stg.isucon.dev.", dns.TypeA)
+	r := exchange(t, "udp", udpAddr, m)
+	if len(r.Ns) != 1 || r.Ns[0].(*dns.SOA).Minttl != 30 || r.Ns[0].(*dns.SOA).Serial != stg.names.Serial() {
+		t.Errorf("want SOA of the staging zone in authority section, got %v", r.Ns)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+// DNSサーバーのメトリクス。
+// serveDNS で動かしている dns.Server の様子をPrometheusのテキスト形式で公開する。
+// スクレイプは Authorization: Bearer か X-Isupipe-Internal-Token で内部トークンを付けて行う。
+const (
+	dnsMetricsPath = "/api/internal/dns/metrics"
+)
+
+// dnsLatencyBuckets はクエリの処理時間のヒストグラムの境界 (秒) です。
+// 応答はメモリ上で組み立てるだけなので、マイクロ秒からミリ秒の範囲を細かく分ける。
+var dnsLatencyBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.1}
+
+var dnsMetrics = newDNSMetricsRecorder()
+
+type dnsMetricKey struct {
+	qtype     string
+	rcode     string
+	transport string
+}
+
+type dnsMetricSeries struct {
+	// buckets[i] は dnsLatencyBuckets[i] 以下だった回数で、累積にはしていない
+	buckets []atomic.Uint64
+	// sumNanos は処理時間の合計です
+	sumNanos atomic.Uint64
+	total    atomic.Uint64
+}
+
+type dnsMetricsRecorder struct {
+	// series は dnsMetricKey から *dnsMetricSeries への対応です。
+	// ラベルの組み合わせはすぐに出揃うので、sync.Map にしてクエリごとにロックを取らないようにする。
+	series sync.Map
+
+	lastInitializeDuration atomic.Int64
+	lastInitializeAt       atomic.Int64
+}
+
+func newDNSMetricsRecorder() *dnsMetricsRecorder {
+	return &dnsMetricsRecorder{}
+}
+
+// Middleware は next で処理したクエリを数えます
+func (m *dnsMetricsRecorder) Middleware(next dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		rw := &recordingResponseWriter{ResponseWriter: w, start: time.Now()}
+		next(rw, r)
+		m.observe(rw, r)
+	}
+}
+
+func (m *dnsMetricsRecorder) observe(w *recordingResponseWriter, r *dns.Msg) {
+	key := dnsMetricKey{qtype: "NONE", rcode: "NONE", transport: transportOf(w.RemoteAddr())}
+	if len(r.Question) > 0 {
+		key.qtype = dnsMetricQtype(r.Question[0].Qtype)
+	}
+	// RRLで捨てた場合は応答が無いので rcode="NONE" として数える
+	latency := time.Since(w.start)
+	if w.msg != nil {
+		key.rcode = dns.RcodeToString[w.msg.Rcode]
+		latency = w.end.Sub(w.start)
+	}
+
+	v, ok := m.series.Load(key)
+	if !ok {
+		v, _ = m.series.LoadOrStore(key, &dnsMetricSeries{buckets: make([]atomic.Uint64, len(dnsLatencyBuckets))})
+	}
+	series := v.(*dnsMetricSeries)
+	series.total.Add(1)
+	series.sumNanos.Add(uint64(latency.Nanoseconds()))
+	for i, le := range dnsLatencyBuckets {
+		if latency.Seconds() <= le {
+			series.buckets[i].Add(1)
+			break
+		}
+	}
+}
+
+// dnsMetricQtype は qtype のラベルを返します。
+// 任意の数値を送られてもラベルが増え続けないよう、対応していないものは OTHER にまとめる。
+func dnsMetricQtype(qtype uint16) string {
+	if supportedRRTypes[qtype] || qtype == dns.TypeAXFR || qtype == dns.TypeIXFR || qtype == dns.TypeANY {
+		return dns.TypeToString[qtype]
+	}
+	return "OTHER"
+}
+
+// observeInitialize は initializeDnsCache にかかった時間を記録します
+func (m *dnsMetricsRecorder) observeInitialize(d time.Duration) {
+	m.lastInitializeDuration.Store(int64(d))
+	m.lastInitializeAt.Store(time.Now().Unix())
+}
+
+// WriteTo はPrometheusのテキスト形式でメトリクスを書き出します
+func (m *dnsMetricsRecorder) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	type entry struct {
+		key    dnsMetricKey
+		series *dnsMetricSeries
+	}
+	var entries []entry
+	m.series.Range(func(k, v any) bool {
+		entries = append(entries, entry{key: k.(dnsMetricKey), series: v.(*dnsMetricSeries)})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].key, entries[j].key
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		if a.rcode != b.rcode {
+			return a.rcode < b.rcode
+		}
+		return a.transport < b.transport
+	})
+
+	b.WriteString("# HELP isupipe_dns_queries_total Number of DNS queries handled.\n")
+	b.WriteString("# TYPE isupipe_dns_queries_total counter\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "isupipe_dns_queries_total{%s} %d\n", e.key.labels(), e.series.total.Load())
+	}
+
+	b.WriteString("# HELP isupipe_dns_query_duration_seconds Time taken to answer DNS queries.\n")
+	b.WriteString("# TYPE isupipe_dns_query_duration_seconds histogram\n")
+	for _, e := range entries {
+		labels := e.key.labels()
+		var cumulative uint64
+		for i, le := range dnsLatencyBuckets {
+			cumulative += e.series.buckets[i].Load()
+			fmt.Fprintf(&b, "isupipe_dns_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, cumulative)
+		}
+		fmt.Fprintf(&b, "isupipe_dns_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, e.series.total.Load())
+		fmt.Fprintf(&b, "isupipe_dns_query_duration_seconds_sum{%s} %g\n", labels, float64(e.series.sumNanos.Load())/1e9)
+		fmt.Fprintf(&b, "isupipe_dns_query_duration_seconds_count{%s} %d\n", labels, e.series.total.Load())
+	}
+
+	b.WriteString("# HELP isupipe_dns_names Number of subdomains the DNS server answers for.\n")
+	b.WriteString("# TYPE isupipe_dns_names gauge\n")
+	for _, zone := range hostedZones {
+		fmt.Fprintf(&b, "isupipe_dns_names{zone=%q} %d\n", zone.origin, zone.names.Len())
+	}
+	b.WriteString("# HELP isupipe_dns_soa_serial Current SOA serial of the zone.\n")
+	b.WriteString("# TYPE isupipe_dns_soa_serial gauge\n")
+	for _, zone := range hostedZones {
+		fmt.Fprintf(&b, "isupipe_dns_soa_serial{zone=%q} %d\n", zone.origin, zone.names.Serial())
+	}
+	writeGauge(&b, "isupipe_dns_initialize_duration_seconds", "Time taken by the last initializeDnsCache.",
+		time.Duration(m.lastInitializeDuration.Load()).Seconds())
+	lastInitializeAt := math.NaN()
+	if v := m.lastInitializeAt.Load(); v != 0 {
+		lastInitializeAt = float64(v)
+	}
+	writeGauge(&b, "isupipe_dns_initialize_timestamp_seconds", "Unix time of the last initializeDnsCache.", lastInitializeAt)
+
+	rrl := dnsRRL.Stats()
+	writeCounter(&b, "isupipe_dns_rrl_sent_total", "Responses sent while rate limiting is enabled.", rrl.Sent)
+	writeCounter(&b, "isupipe_dns_rrl_dropped_total", "Responses dropped by rate limiting.", rrl.Dropped)
+	writeCounter(&b, "isupipe_dns_rrl_slipped_total", "Truncated responses sent instead of dropping.", rrl.Slipped)
+
+	querylog := dnsQueryLog.status()
+	writeCounter(&b, "isupipe_dns_querylog_written_total", "Query log entries written.", querylog.Written)
+	writeCounter(&b, "isupipe_dns_querylog_dropped_total", "Query log entries dropped.", querylog.Dropped)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (k dnsMetricKey) labels() string {
+	return fmt.Sprintf("qtype=%q,rcode=%q,transport=%q", k.qtype, k.rcode, k.transport)
+}
+
+func writeGauge(b *strings.Builder, name string, help string, v float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
+
+func writeCounter(b *strings.Builder, name string, help string, v uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+// DNSサーバーのメトリクス取得API
+// GET /api/internal/dns/metrics
+func dnsMetricsHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, dnsSync.token); err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	_, err := dnsMetrics.WriteTo(c.Response())
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSMetricsRecorder(t *testing.T) {
+	m := newDNSMetricsRecorder()
+	handler := m.Middleware(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		if r.Question[0].Name == "nobody.u.isucon.dev." {
+			reply.SetRcode(r, dns.RcodeNameError)
+		} else {
+			reply.SetReply(r)
+		}
+		_ = w.WriteMsg(reply)
+	})
+	udp := &testResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	tcp := &testResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	for _, q := range []struct {
+		w     dns.ResponseWriter
+		qname string
+		qtype uint16
+	}{
+		{udp, "alice.u.isucon.dev.", dns.TypeA},
+		{udp, "alice.u.isucon.dev.", dns.TypeA},
+		{tcp, "alice.u.isucon.dev.", dns.TypeAAAA},
+		{udp, "nobody.u.isucon.dev.", dns.TypeA},
+		{udp, "alice.u.isucon.dev.", 65000},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(q.qname, q.qtype)
+		handler(q.w, r)
+	}
+	m.observeInitialize(1500 * time.Millisecond)
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`isupipe_dns_queries_total{qtype="A",rcode="NOERROR",transport="udp"} 2`,
+		`isupipe_dns_queries_total{qtype="AAAA",rcode="NOERROR",transport="tcp"} 1`,
+		`isupipe_dns_queries_total{qtype="A",rcode="NXDOMAIN",transport="udp"} 1`,
+		`isupipe_dns_queries_total{qtype="OTHER",rcode="NOERROR",transport="udp"} 1`,
+		`isupipe_dns_query_duration_seconds_bucket{qtype="A",rcode="NOERROR",transport="udp",le="+Inf"} 2`,
+		`isupipe_dns_query_duration_seconds_count{qtype="A",rcode="NOERROR",transport="udp"} 2`,
+		`isupipe_dns_initialize_duration_seconds 1.5`,
+		"# TYPE isupipe_dns_names gauge",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics must contain %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/isuutil"
+	"github.com/miekg/dns"
+)
+
+// ゾーンが変わったときにセカンダリ (PowerDNSやBIND) へDNS NOTIFY (RFC 1996) を送る。
+// 登録が続くと毎回送ることになるので、isuutil.Worker で一定間隔にまとめてから最新のシリアルだけを通知する。
+const (
+	dnsNotifyEnvKey = "ISUCON13_DNS_NOTIFY"
+
+	dnsNotifyInterval = 1 * time.Second
+	dnsNotifyTimeout  = 2 * time.Second
+)
+
+type dnsNotifier struct {
+	zone *hostedZone
+	// targets は "192.0.2.10:53" のようなセカンダリのアドレスです
+	targets []string
+	worker  *isuutil.Worker[uint32]
+	client  *dns.Client
+}
+
+// newZoneNotifier は zone の設定から通知先を読み込みます。
+// 本番のゾーンで設定が無ければ、環境変数からカンマ区切りで読み込む。ポートを省略した場合は53番を使う。
+func newZoneNotifier(zone *hostedZone) *dnsNotifier {
+	targets := zone.config.Notify
+	if len(targets) == 0 && zone == primaryZone() {
+		targets = strings.Split(os.Getenv(dnsNotifyEnvKey), ",")
+	}
+	var addrs []string
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+		addrs = append(addrs, target)
+	}
+	return newDNSNotifier(zone, addrs)
+}
+
+func newDNSNotifier(zone *hostedZone, targets []string) *dnsNotifier {
+	return &dnsNotifier{
+		zone:    zone,
+		targets: targets,
+		worker:  isuutil.NewWorker[uint32](dnsNotifyInterval),
+		client:  &dns.Client{Net: "udp", Timeout: dnsNotifyTimeout},
+	}
+}
+
+// Notify はシリアルが serial に変わったことを通知キューに積みます
+func (n *dnsNotifier) Notify(serial uint32) {
+	if len(n.targets) == 0 {
+		return
+	}
+	n.worker.Send(serial)
+}
+
+// Run は通知を送るworkerを起動します。goroutineで動かすことが想定されています。
+func (n *dnsNotifier) Run() {
+	if len(n.targets) == 0 {
+		return
+	}
+	n.worker.Run(func(serials []uint32) {
+		n.send(serials[len(serials)-1])
+	})
+}
+
+// send はすべてのセカンダリにNOTIFYを送ります。
+// 届かなくてもセカンダリはSOAのREFRESH間隔で追いつくので、エラーは無視する。
+func (n *dnsNotifier) send(serial uint32) {
+	zone := n.zone.file.Load()
+	if zone == nil {
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetNotify(n.zone.origin)
+	m.Authoritative = true
+	soa := *zone.SOA
+	soa.Serial = serial
+	m.Answer = append(m.Answer, &soa)
+
+	for _, target := range n.targets {
+		go func(target string) {
+			if _, _, err := n.client.Exchange(m.Copy(), target); err != nil {
+				//log.Printf("[ERR] failed to notify %s: %v", target, err)
+			}
+		}(target)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSNames_Serial(t *testing.T) {
+	n := newDNSNames()
+	var notified []uint32
+	n.onChange = func(serial uint32) { notified = append(notified, serial) }
+
+	s0 := n.Serial()
+	n.Add("alice")
+	if n.Serial() != s0+1 {
+		t.Errorf("serial must advance on add: %d -> %d", s0, n.Serial())
+	}
+	n.Add("alice")
+	if n.Serial() != s0+1 {
+		t.Errorf("serial must not advance when nothing changes")
+	}
+	n.Reset([]string{"alice"})
+	if n.Serial() != s0+1 {
+		t.Errorf("serial must not advance when reset to the same set")
+	}
+	n.Reset([]string{"bob"})
+	if n.Serial() != s0+2 {
+		t.Errorf("serial must advance on reset")
+	}
+	if len(notified) != 2 || notified[1] != s0+2 {
+		t.Errorf("unexpected notifications: %v", notified)
+	}
+}
+
+func TestDNSNotifier_Send(t *testing.T) {
+	startTestDNSServer(t, testZone)
+
+	got := make(chan *dns.Msg, 1)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen udp: %v", err)
+	}
+	secondary := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		got <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})}
+	go secondary.ActivateAndServe()
+	t.Cleanup(func() { _ = secondary.Shutdown() })
+
+	n := newDNSNotifier(primaryZone(), []string{pc.LocalAddr().String()})
+	n.send(42)
+
+	select {
+	case r := <-got:
+		if r.Opcode != dns.OpcodeNotify {
+			t.Errorf("want opcode NOTIFY, got %s", dns.OpcodeToString[r.Opcode])
+		}
+		if r.Question[0].Name != dns.Fqdn(domain) || r.Question[0].Qtype != dns.TypeSOA {
+			t.Errorf("unexpected question: %v", r.Question[0])
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Serial != 42 {
+			t.Errorf("want SOA with serial 42, got %v", r.Answer)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("notify is not received")
+	}
+}
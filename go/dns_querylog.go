@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+// DNSのクエリログ。
+// ベンチマーカーがDNSの失敗を報告したときに調べられるよう、1クエリ1行のJSONをファイルかUnixドメインソケットに書き出す。
+// クエリを処理するgoroutineでは channel に積むだけにして、書き出しは別のgoroutineでまとめて行う。
+// channel が溢れた場合は待たずに捨てるので、ベンチ中に有効にしたままでも応答は遅くならない。
+const (
+	// ISUCON13_DNS_QUERYLOG は "file:/var/log/isupipe/dns.jsonl" か "unix:/run/isupipe/dns.sock" の形式で指定する
+	dnsQueryLogEnvKey        = "ISUCON13_DNS_QUERYLOG"
+	dnsQueryLogEnabledEnvKey = "ISUCON13_DNS_QUERYLOG_ENABLED"
+
+	dnsQueryLogPath = "/api/internal/dns/querylog"
+
+	dnsQueryLogBufferSize    = 65536
+	dnsQueryLogFlushInterval = 1 * time.Second
+)
+
+var dnsQueryLog = newDNSQueryLoggerFromEnv()
+
+type DNSQueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Qname     string    `json:"qname"`
+	Qtype     string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	// LatencyUs はクエリを受け取ってから応答を書き込むまでのマイクロ秒です
+	LatencyUs int64 `json:"latency_us"`
+	// Responded はRRLなどで応答を返さなかった場合に false になる
+	Responded bool `json:"responded"`
+}
+
+type dnsQueryLogger struct {
+	network string
+	address string
+	enabled atomic.Bool
+	ch      chan DNSQueryLogEntry
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func newDNSQueryLoggerFromEnv() *dnsQueryLogger {
+	l := newDNSQueryLogger(os.Getenv(dnsQueryLogEnvKey))
+	if v, err := strconv.ParseBool(os.Getenv(dnsQueryLogEnabledEnvKey)); err == nil {
+		l.SetEnabled(v)
+	}
+	return l
+}
+
+// newDNSQueryLogger は dest に書き出すロガーを作ります。dest が空なら何も書き出さない。
+func newDNSQueryLogger(dest string) *dnsQueryLogger {
+	l := &dnsQueryLogger{ch: make(chan DNSQueryLogEntry, dnsQueryLogBufferSize)}
+	if network, address, ok := strings.Cut(dest, ":"); ok && (network == "file" || network == "unix") {
+		l.network = network
+		l.address = address
+	}
+	return l
+}
+
+func (l *dnsQueryLogger) Configured() bool {
+	return l.network != ""
+}
+
+// SetEnabled は実行中にログの出力を切り替えます
+func (l *dnsQueryLogger) SetEnabled(enabled bool) bool {
+	if !l.Configured() {
+		return false
+	}
+	l.enabled.Store(enabled)
+	return true
+}
+
+// Middleware は next で処理したクエリをログに積みます
+func (l *dnsQueryLogger) Middleware(next dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !l.enabled.Load() {
+			next(w, r)
+			return
+		}
+		lw := &recordingResponseWriter{ResponseWriter: w, start: time.Now()}
+		next(lw, r)
+		l.log(lw, r)
+	}
+}
+
+func (l *dnsQueryLogger) log(w *recordingResponseWriter, r *dns.Msg) {
+	entry := DNSQueryLogEntry{
+		Time:      w.start,
+		Client:    w.RemoteAddr().String(),
+		Transport: transportOf(w.RemoteAddr()),
+		Responded: w.msg != nil,
+	}
+	if len(r.Question) > 0 {
+		entry.Qname = r.Question[0].Name
+		entry.Qtype = dns.TypeToString[r.Question[0].Qtype]
+	}
+	if w.msg != nil {
+		entry.Rcode = dns.RcodeToString[w.msg.Rcode]
+		entry.LatencyUs = w.end.Sub(w.start).Microseconds()
+	}
+
+	select {
+	case l.ch <- entry:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Run はログを書き出すworkerです。goroutineで動かすことが想定されています。
+func (l *dnsQueryLogger) Run() {
+	if !l.Configured() {
+		return
+	}
+
+	var (
+		dst io.WriteCloser
+		bw  *bufio.Writer
+		enc *json.Encoder
+	)
+	closeDst := func() {
+		if dst != nil {
+			_ = dst.Close()
+			dst = nil
+		}
+	}
+	flush := func() {
+		if bw == nil || bw.Buffered() == 0 {
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			// ソケットの相手がいなくなった場合などは次のログで繋ぎ直す
+			closeDst()
+		}
+	}
+
+	ticker := time.NewTicker(dnsQueryLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-l.ch:
+			if dst == nil {
+				var err error
+				dst, err = l.open()
+				if err != nil {
+					l.dropped.Add(1)
+					continue
+				}
+				bw = bufio.NewWriterSize(dst, 64*1024)
+				enc = json.NewEncoder(bw)
+			}
+			if err := enc.Encode(entry); err != nil {
+				l.dropped.Add(1)
+				closeDst()
+				continue
+			}
+			l.written.Add(1)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (l *dnsQueryLogger) open() (io.WriteCloser, error) {
+	switch l.network {
+	case "file":
+		return os.OpenFile(l.address, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	case "unix":
+		return net.DialTimeout("unix", l.address, 1*time.Second)
+	}
+	return nil, fmt.Errorf("unknown query log destination: %s", l.network)
+}
+
+// recordingResponseWriter は書き込まれた応答と時刻を記録します。クエリログとメトリクスで使う。
+type recordingResponseWriter struct {
+	dns.ResponseWriter
+	start time.Time
+	end   time.Time
+	msg   *dns.Msg
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	if w.msg == nil {
+		w.msg = m
+		w.end = time.Now()
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func transportOf(addr net.Addr) string {
+	if _, ok := addr.(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+type DNSQueryLogStatus struct {
+	Configured bool   `json:"configured"`
+	Enabled    bool   `json:"enabled"`
+	Written    uint64 `json:"written"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+type PutDNSQueryLogRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (l *dnsQueryLogger) status() DNSQueryLogStatus {
+	return DNSQueryLogStatus{
+		Configured: l.Configured(),
+		Enabled:    l.enabled.Load(),
+		Written:    l.written.Load(),
+		Dropped:    l.dropped.Load(),
+	}
+}
+
+// クエリログの状態取得API
+// GET /api/internal/dns/querylog
+func getDNSQueryLogHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, dnsSync.token); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dnsQueryLog.status())
+}
+
+// クエリログの有効/無効切り替えAPI
+// PUT /api/internal/dns/querylog
+func putDNSQueryLogHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, dnsSync.token); err != nil {
+		return err
+	}
+	defer c.Request().Body.Close()
+
+	req := PutDNSQueryLogRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if !dnsQueryLog.SetEnabled(req.Enabled) {
+		return echo.NewHTTPError(http.StatusConflict, dnsQueryLogEnvKey+" is not configured")
+	}
+	return c.JSON(http.StatusOK, dnsQueryLog.status())
+}
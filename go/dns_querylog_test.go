@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	// written は最後に書き込まれた応答です
+	written *dns.Msg
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.written = m
+	return nil
+}
+
+func TestDNSQueryLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.jsonl")
+	l := newDNSQueryLogger("file:" + path)
+	go l.Run()
+
+	handler := l.Middleware(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		_ = w.WriteMsg(m)
+	})
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	r := new(dns.Msg)
+	r.SetQuestion("nobody.u.isucon.dev.", dns.TypeA)
+
+	// 無効な間は何も記録しない
+	handler(w, r)
+	if !l.SetEnabled(true) {
+		t.Fatalf("query log must be configured")
+	}
+	handler(w, r)
+
+	var entries []DNSQueryLogEntry
+	deadline := time.Now().Add(3 * time.Second)
+	for len(entries) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var entry DNSQueryLogEntry
+			if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+				t.Fatalf("invalid json line: %s", sc.Text())
+			}
+			entries = append(entries, entry)
+		}
+		f.Close()
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("want 1 entry, got %d", len(entries))
+	}
+	got := entries[0]
+	if got.Qname != "nobody.u.isucon.dev." || got.Qtype != "A" || got.Rcode != "NXDOMAIN" ||
+		got.Client != "192.0.2.1:5353" || got.Transport != "udp" || !got.Responded {
+		t.Errorf("unexpected entry: %+v", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	powerDNSSubdomainAddressV6EnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS_V6"
+	dnsAliasAllowlistEnvKey          = "ISUCON13_DNS_ALIAS_ALLOWLIST"
+
+	// ユーザ名から合成するレコードのTTLの既定値
+	userRecordTTL = 300
+	// CNAMEをゾーン内で辿る最大回数
+	maxCNAMEChain = 8
+)
+
+var (
+	// powerDNSSubdomainAddressV6 が空ならユーザ名に対するAAAAはNODATAになる
+	powerDNSSubdomainAddressV6 string
+	// dnsAliasAllowlist はCNAMEとMXを持つことが許されたサブドメインです。
+	// CNAMEによるSubdomain Takeoverを防ぐため、ゾーンファイルにあってもここに無いものは読み込まない。
+	dnsAliasAllowlist = map[string]bool{}
+)
+
+func init() {
+	powerDNSSubdomainAddressV6 = os.Getenv(powerDNSSubdomainAddressV6EnvKey)
+	for _, name := range strings.Split(os.Getenv(dnsAliasAllowlistEnvKey), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			dnsAliasAllowlist[strings.ToLower(name)] = true
+		}
+	}
+}
+
+// 応答できるレコードの型。NewRRやNewZoneParserを使うとほとんどあらゆるレコードに対応可能になるが、
+// 同時にCNAMEによるSubdomain Takeoverなどリスクを負うことになるので必要なものだけ追加する
+var supportedRRTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeNS:    true,
+	dns.TypeSOA:   true,
+	dns.TypeTXT:   true,
+	dns.TypeMX:    true,
+	dns.TypeCNAME: true,
+}
+
+// acceptZoneRecord はゾーンファイルのレコードを応答に使ってよいかを判定します
+func acceptZoneRecord(rr dns.RR, origin string) bool {
+	t := rr.Header().Rrtype
+	if !supportedRRTypes[t] {
+		return false
+	}
+	if t == dns.TypeCNAME || t == dns.TypeMX {
+		sub := strings.TrimSuffix(strings.ToLower(rr.Header().Name), "."+dns.Fqdn(origin))
+		return dnsAliasAllowlist[sub]
+	}
+	return true
+}
+
+// lookupRecords は name (FQDN) が持つレコードを返します。
+// 2つ目の戻り値はその名前がゾーン内に存在するかどうかで、falseならNXDOMAINとなる。
+func lookupRecords(zone *hostedZone, name string, subDomain string) ([]dns.RR, bool) {
+	if rrs := zone.file.Load().lookup(name); len(rrs) > 0 {
+		return rrs, true
+	}
+	if subDomain == "" || !zone.names.Has(subDomain) {
+		return nil, false
+	}
+	return synthesizeUserRecords(zone, name, subDomain), true
+}
+
+// synthesizeUserRecords はユーザ名に対するレコードを合成します。
+// ユーザ名はA(とAAAA)のみを持つ。
+func synthesizeUserRecords(zone *hostedZone, name string, subDomain string) []dns.RR {
+	var rrs []dns.RR
+	rrs = append(rrs, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: zone.config.UserTTL},
+		A:   net.ParseIP(zone.userAddress(subDomain)),
+	})
+	if powerDNSSubdomainAddressV6 != "" {
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: zone.config.UserTTL},
+			AAAA: net.ParseIP(powerDNSSubdomainAddressV6),
+		})
+	}
+	return rrs
+}
+
+// answerQuestion は q に対する応答を m に詰めます。
+// 名前が存在しない場合はNXDOMAIN、型が無い場合はNODATAとして、AuthorityセクションにSOAを入れる。
+func answerQuestion(m *dns.Msg, zone *hostedZone, q dns.Question, subDomain string) {
+	name := q.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		rrs, ok := lookupRecords(zone, name, subDomain)
+		if !ok {
+			if i > 0 {
+				// CNAMEの先が存在しない場合は、CNAMEだけ返してリゾルバに任せる
+				return
+			}
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, negativeSOA(zone))
+			return
+		}
+
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype:
+				if soa, ok := rr.(*dns.SOA); ok {
+					rr = withSerial(zone, soa)
+				}
+				m.Answer = append(m.Answer, withOwner(rr, name))
+				found = true
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if found {
+			return
+		}
+		if cname == nil {
+			// 名前はあるが型が無いのでNODATA
+			m.Ns = append(m.Ns, negativeSOA(zone))
+			return
+		}
+
+		m.Answer = append(m.Answer, withOwner(cname, name))
+		name = strings.ToLower(cname.Target)
+		if subDomain, ok = zone.split(name); !ok {
+			return
+		}
+	}
+}
+
+// withOwner は問い合わせの名前の大文字小文字を保ったままレコードを返します
+func withOwner(rr dns.RR, name string) dns.RR {
+	if rr.Header().Name == name {
+		return rr
+	}
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
+
+// negativeSOA はNODATA/NXDOMAINのAuthorityセクションに入れるSOAを返します。
+// RFC 2308 に従い、TTLはSOAのTTLとMINIMUMの小さい方にする。
+func negativeSOA(zone *hostedZone) *dns.SOA {
+	soa := withSerial(zone, zone.file.Load().SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// withSerial はゾーンファイルのSOAのシリアルを現在の値に置き換えたものを返します
+func withSerial(zone *hostedZone, soa *dns.SOA) *dns.SOA {
+	s := *soa
+	s.Serial = zone.names.Serial()
+	return &s
+}
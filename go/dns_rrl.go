@@ -0,0 +1,266 @@
+package main
+
+import (
+	"hash/maphash"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+// DNSのResponse Rate Limiting (RRL)。
+// ベンチマーカーは存在しないサブドメインを大量に問い合わせてくる (いわゆる水責め攻撃) ので、
+// 送信元のプレフィックスごとに応答数を制限し、超えた分は捨てるか TC ビットを立ててTCPでの再送を促す。
+// TCPは送信元を詐称できないので制限しない。
+const (
+	dnsRRLResponsesPerSecondEnvKey = "ISUCON13_DNS_RRL_RESPONSES_PER_SECOND"
+	dnsRRLNXDomainsPerSecondEnvKey = "ISUCON13_DNS_RRL_NXDOMAINS_PER_SECOND"
+	dnsRRLWindowEnvKey             = "ISUCON13_DNS_RRL_WINDOW"
+	dnsRRLSlipEnvKey               = "ISUCON13_DNS_RRL_SLIP"
+	dnsRRLIPv4PrefixLenEnvKey      = "ISUCON13_DNS_RRL_IPV4_PREFIX_LEN"
+	dnsRRLIPv6PrefixLenEnvKey      = "ISUCON13_DNS_RRL_IPV6_PREFIX_LEN"
+
+	dnsRRLStatsPath = "/api/internal/dns/rrl"
+
+	dnsRRLShards = 64
+)
+
+var dnsRRL = newResponseRateLimiter(dnsRRLConfigFromEnv())
+
+type dnsRRLConfig struct {
+	// ResponsesPerSecond は1つのプレフィックスに返す1秒あたりの応答数です。0なら制限しない。
+	ResponsesPerSecond float64
+	// NXDomainsPerSecond はNXDOMAINに対する制限です。0なら ResponsesPerSecond と同じ。
+	// ランダムなサブドメインへの問い合わせを通常の応答より強く絞るためのもの。
+	NXDomainsPerSecond float64
+	// Window は溜めておける応答数を秒数で表したものです。バースト許容量は rate * Window になる。
+	Window time.Duration
+	// Slip は制限にかかった応答の何回に1回をTC付きで返すかです。0なら全て捨て、1なら全て返す。
+	Slip int
+	// IPv4PrefixLen, IPv6PrefixLen は送信元をまとめるプレフィックス長です
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+}
+
+func defaultDNSRRLConfig() dnsRRLConfig {
+	return dnsRRLConfig{
+		Window:        1 * time.Second,
+		Slip:          2,
+		IPv4PrefixLen: 24,
+		IPv6PrefixLen: 56,
+	}
+}
+
+// dnsRRLConfigFromEnv は環境変数から設定を読み込みます。
+// 不正な値はエラーにせずデフォルト値のままにする (DNSが起動しない方が困るため)。
+func dnsRRLConfigFromEnv() dnsRRLConfig {
+	conf := defaultDNSRRLConfig()
+	if v, err := strconv.ParseFloat(os.Getenv(dnsRRLResponsesPerSecondEnvKey), 64); err == nil {
+		conf.ResponsesPerSecond = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv(dnsRRLNXDomainsPerSecondEnvKey), 64); err == nil {
+		conf.NXDomainsPerSecond = v
+	}
+	if v, err := time.ParseDuration(os.Getenv(dnsRRLWindowEnvKey)); err == nil && v > 0 {
+		conf.Window = v
+	}
+	if v, err := strconv.Atoi(os.Getenv(dnsRRLSlipEnvKey)); err == nil && v >= 0 {
+		conf.Slip = v
+	}
+	if v, err := strconv.Atoi(os.Getenv(dnsRRLIPv4PrefixLenEnvKey)); err == nil && v >= 0 && v <= 32 {
+		conf.IPv4PrefixLen = v
+	}
+	if v, err := strconv.Atoi(os.Getenv(dnsRRLIPv6PrefixLenEnvKey)); err == nil && v >= 0 && v <= 128 {
+		conf.IPv6PrefixLen = v
+	}
+	return conf
+}
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+type rrlKey struct {
+	prefix string
+	nx     bool
+}
+
+type rrlBucket struct {
+	tokens  float64
+	updated time.Time
+	limited int
+}
+
+type rrlShard struct {
+	mu      sync.Mutex
+	buckets map[rrlKey]*rrlBucket
+	swept   time.Time
+}
+
+type responseRateLimiter struct {
+	conf   dnsRRLConfig
+	seed   maphash.Seed
+	shards [dnsRRLShards]rrlShard
+	now    func() time.Time
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+	slipped atomic.Uint64
+}
+
+func newResponseRateLimiter(conf dnsRRLConfig) *responseRateLimiter {
+	l := &responseRateLimiter{
+		conf: conf,
+		seed: maphash.MakeSeed(),
+		now:  time.Now,
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = map[rrlKey]*rrlBucket{}
+	}
+	return l
+}
+
+func (l *responseRateLimiter) Enabled() bool {
+	return l.conf.ResponsesPerSecond > 0
+}
+
+// prefix は送信元アドレスを設定されたプレフィックス長で丸めます
+func (l *responseRateLimiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.conf.IPv4PrefixLen, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(l.conf.IPv6PrefixLen, 128)).String()
+}
+
+// check は送信元 ip に対して rcode の応答を返してよいかを判定します
+func (l *responseRateLimiter) check(ip net.IP, rcode int) rrlAction {
+	key := rrlKey{prefix: l.prefix(ip), nx: rcode == dns.RcodeNameError}
+	rate := l.conf.ResponsesPerSecond
+	if key.nx && l.conf.NXDomainsPerSecond > 0 {
+		rate = l.conf.NXDomainsPerSecond
+	}
+	burst := rate * l.conf.Window.Seconds()
+
+	shard := &l.shards[maphash.String(l.seed, key.prefix)%dnsRRLShards]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := l.now()
+	l.sweep(shard, now)
+
+	b, ok := shard.buckets[key]
+	if !ok {
+		b = &rrlBucket{tokens: burst, updated: now}
+		shard.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		l.sent.Add(1)
+		return rrlSend
+	}
+
+	b.limited++
+	if l.conf.Slip > 0 && b.limited%l.conf.Slip == 0 {
+		l.slipped.Add(1)
+		return rrlSlip
+	}
+	l.dropped.Add(1)
+	return rrlDrop
+}
+
+// sweep は満タンまで回復したバケツを捨てて、送信元が増え続けてもメモリを食い潰さないようにします
+func (l *responseRateLimiter) sweep(shard *rrlShard, now time.Time) {
+	if now.Sub(shard.swept) < l.conf.Window {
+		return
+	}
+	shard.swept = now
+	for key, b := range shard.buckets {
+		if now.Sub(b.updated) >= l.conf.Window {
+			delete(shard.buckets, key)
+		}
+	}
+}
+
+// Middleware は next の応答にRRLを適用します
+func (l *responseRateLimiter) Middleware(next dns.HandlerFunc) dns.HandlerFunc {
+	if !l.Enabled() {
+		return next
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		addr, ok := w.RemoteAddr().(*net.UDPAddr)
+		if !ok {
+			next(w, r)
+			return
+		}
+		next(&rrlResponseWriter{ResponseWriter: w, limiter: l, ip: addr.IP}, r)
+	}
+}
+
+// rrlResponseWriter は最初の応答でRRLの判定を行い、以降の書き込みにも同じ判定を適用します
+type rrlResponseWriter struct {
+	dns.ResponseWriter
+	limiter *responseRateLimiter
+	ip      net.IP
+	decided bool
+	action  rrlAction
+}
+
+func (w *rrlResponseWriter) WriteMsg(m *dns.Msg) error {
+	if !w.decided {
+		w.decided = true
+		w.action = w.limiter.check(w.ip, m.Rcode)
+	}
+
+	switch w.action {
+	case rrlDrop:
+		return nil
+	case rrlSlip:
+		// 中身を空にしてTCを立て、TCPで問い合わせ直させる
+		tc := new(dns.Msg)
+		tc.SetReply(m)
+		tc.Rcode = m.Rcode
+		tc.Authoritative = m.Authoritative
+		tc.Truncated = true
+		return w.ResponseWriter.WriteMsg(tc)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+type DNSRRLStats struct {
+	Enabled bool   `json:"enabled"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+	Slipped uint64 `json:"slipped"`
+}
+
+func (l *responseRateLimiter) Stats() DNSRRLStats {
+	return DNSRRLStats{
+		Enabled: l.Enabled(),
+		Sent:    l.sent.Load(),
+		Dropped: l.dropped.Load(),
+		Slipped: l.slipped.Load(),
+	}
+}
+
+// RRLのカウンタ取得API
+// GET /api/internal/dns/rrl
+func dnsRRLStatsHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, dnsSync.token); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dnsRRL.Stats())
+}
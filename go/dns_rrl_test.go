@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseRateLimiter_Check(t *testing.T) {
+	conf := defaultDNSRRLConfig()
+	conf.ResponsesPerSecond = 2
+	conf.NXDomainsPerSecond = 1
+	conf.Slip = 2
+	l := newResponseRateLimiter(conf)
+
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	src := net.ParseIP("192.0.2.1")
+	// 同じ /24 からの問い合わせはまとめて数える
+	neighbor := net.ParseIP("192.0.2.200")
+
+	want := []rrlAction{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop}
+	for i, w := range want {
+		ip := src
+		if i%2 == 1 {
+			ip = neighbor
+		}
+		if got := l.check(ip, dns.RcodeSuccess); got != w {
+			t.Errorf("response %d: want %v, got %v", i, w, got)
+		}
+	}
+
+	// NXDOMAINは別のバケツで、より厳しく制限される
+	if got := l.check(src, dns.RcodeNameError); got != rrlSend {
+		t.Errorf("want first nxdomain to be sent, got %v", got)
+	}
+	if got := l.check(src, dns.RcodeNameError); got == rrlSend {
+		t.Errorf("want second nxdomain to be limited")
+	}
+
+	// 別のプレフィックスには影響しない
+	if got := l.check(net.ParseIP("198.51.100.1"), dns.RcodeSuccess); got != rrlSend {
+		t.Errorf("want another prefix to be sent, got %v", got)
+	}
+
+	// 時間が経てば回復する
+	now = now.Add(1 * time.Second)
+	if got := l.check(src, dns.RcodeSuccess); got != rrlSend {
+		t.Errorf("want to be sent after refill, got %v", got)
+	}
+
+	stats := l.Stats()
+	if stats.Dropped == 0 || stats.Slipped == 0 {
+		t.Errorf("counters are not updated: %+v", stats)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SOAシリアルの保存。
+// シリアルは変更のたびに1つ進むので、時刻から始めるだけでは登録が多いと再起動で巻き戻ってしまう。
+// 巻き戻るとセカンダリはNOTIFYやIXFRを無視するので、ゾーンごとに使ってよいシリアルの上限をファイルに保存しておく。
+const (
+	dnsSerialDirEnvKey = "ISUCON13_DNS_SERIAL_DIR"
+
+	defaultDNSSerialDir = "../dns_serial"
+)
+
+// dnsSerialDir は環境変数で指定されていなければ、ゾーンファイルと同じくリポジトリからの相対パスにする
+func dnsSerialDir() string {
+	if v, ok := os.LookupEnv(dnsSerialDirEnvKey); ok {
+		return v
+	}
+	return defaultDNSSerialDir
+}
+
+// dnsSerialPath は zone (FQDN) のシリアルを保存するファイルです
+func dnsSerialPath(dir string, zone string) string {
+	return filepath.Join(dir, strings.TrimSuffix(zone, ".")+".serial")
+}
+
+// loadDNSSerial は保存したシリアルを返します。まだ保存していなければ 0 を返す。
+func loadDNSSerial(path string) (uint32, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dns serial: %w", err)
+	}
+	serial, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse dns serial in %s: %w", path, err)
+	}
+	return uint32(serial), nil
+}
+
+// saveDNSSerial は途中で落ちても壊れたファイルが残らないよう、一時ファイルに書いてから置き換えます
+func saveDNSSerial(path string, serial uint32) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create dns serial dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(uint64(serial), 10)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write dns serial: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save dns serial: %w", err)
+	}
+	return nil
+}
+
+// restoreSerial はゾーンのシリアルを保存したものの次から始め、以後の変更で保存するようにします
+func (z *hostedZone) restoreSerial(dir string, onError func(error)) error {
+	path := dnsSerialPath(dir, z.origin)
+	persisted, err := loadDNSSerial(path)
+	if err != nil {
+		return err
+	}
+	return z.names.RestoreSerial(persisted, func(serial uint32) error {
+		err := saveDNSSerial(path, serial)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDNSNames_RestoreSerial(t *testing.T) {
+	dir := t.TempDir()
+	path := dnsSerialPath(dir, "u.isucon.dev.")
+
+	n := newDNSNames()
+	if err := n.RestoreSerial(0, func(serial uint32) error { return saveDNSSerial(path, serial) }); err != nil {
+		t.Fatalf("failed to restore serial: %v", err)
+	}
+	// 1秒の間に保存した範囲を超えて変更され、時刻を追い越す
+	for i := 0; i < dnsSerialReserve*2; i++ {
+		n.Add(fmt.Sprintf("user%d", i))
+	}
+	last := n.Serial()
+
+	// 再起動しても、それまでに使ったシリアルより後から始まる
+	persisted, err := loadDNSSerial(path)
+	if err != nil {
+		t.Fatalf("failed to load serial: %v", err)
+	}
+	restarted := newDNSNames()
+	if err := restarted.RestoreSerial(persisted, func(uint32) error { return nil }); err != nil {
+		t.Fatalf("failed to restore serial: %v", err)
+	}
+	if !serialAfter(restarted.Serial(), last) {
+		t.Errorf("serial must not go backwards after restart: %d -> %d", last, restarted.Serial())
+	}
+}
+
+func TestDNSNames_RestoreSerial_PrefersClock(t *testing.T) {
+	// 保存した値より時刻の方が進んでいれば、これまでどおり時刻から始める
+	n := newDNSNames()
+	if err := n.RestoreSerial(1000, nil); err != nil {
+		t.Fatalf("failed to restore serial: %v", err)
+	}
+	if now := uint32(time.Now().Unix()); serialAfter(now-1, n.Serial()) {
+		t.Errorf("want a serial from the clock, got %d", n.Serial())
+	}
+	if serial, err := loadDNSSerial(dnsSerialPath(t.TempDir(), "u.isucon.dev.")); err != nil || serial != 0 {
+		t.Errorf("want 0 before saving, got (%d, %v)", serial, err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon13/webapp/go/isuutil"
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザごとのDNSの振り分け。
+// <username>.u.isucon.dev を、そのユーザのデータを持つシャードのノードに向ける。
+// シャードの選択は isuutil.Shards と同じ ShardConfig の重みとユーザIDで行うので、DBの振り分けと必ず一致する。
+// DBとアプリが別のホストで動くこともあるので、DNSで応答するアドレスはDBのホストとは別に指定できる。
+const (
+	// ISUCON13_USER_SHARDS は "192.168.0.12:1,192.168.0.13:4" のように "DBのホスト:重み" をカンマ区切りで指定する。
+	// アプリが別のホストにあれば "192.168.0.12:1:192.168.0.22" のように3つめにアプリのアドレスを書く。
+	userShardsEnvKey = "ISUCON13_USER_SHARDS"
+
+	dnsShardsPath = "/api/internal/dns/shards"
+	// dnsSyncShardsPath はピアに更新後のシャード構成を伝えるAPIで、受けたノードはそれ以上伝搬させない
+	dnsSyncShardsPath = "/api/internal/dns/shards/sync"
+)
+
+var userShards = newDNSShardRouter()
+
+// dnsShardRouter はユーザ名をシャードのアドレスに振り分けます。
+// Address はクエリごとに呼ばれるので、dnsNames と同じく変更のたびにmapを作り直して atomic に差し替え、ロックを取らずに引く。
+type dnsShardRouter struct {
+	set atomic.Pointer[dnsShardSet]
+
+	// userIDs はユーザ名からシャードキーにするユーザIDへの対応で、格納した後は変更しない
+	userIDs atomic.Pointer[map[string]int64]
+	// mu は userIDs の変更を守ります
+	mu sync.Mutex
+}
+
+// dnsShardSet はシャード構成で、shards[i] と configs[i] は同じシャードを表す。
+// configs はDBの振り分けと同じシャードを選ぶためだけに使い、応答するアドレスは shards[i].Address にする。
+type dnsShardSet struct {
+	shards  []DNSUserShard
+	configs []*isuutil.ShardConfig
+}
+
+func newDNSShardRouter() *dnsShardRouter {
+	r := &dnsShardRouter{}
+	r.userIDs.Store(&map[string]int64{})
+	return r
+}
+
+// userShardsFromEnv は環境変数からユーザのシャード構成を読み込みます
+func userShardsFromEnv() ([]DNSUserShard, error) {
+	v := os.Getenv(userShardsEnvKey)
+	if v == "" {
+		return nil, nil
+	}
+	var shards []DNSUserShard
+	for _, s := range strings.Split(v, ",") {
+		fields := strings.Split(strings.TrimSpace(s), ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("invalid shard '%s' in environment variable '%s'", s, userShardsEnvKey)
+		}
+		w, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse weight of shard '%s': %w", s, err)
+		}
+		shard := DNSUserShard{Name: fields[0], Host: fields[0], Weight: w}
+		if len(fields) == 3 {
+			shard.Address = fields[2]
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// newDNSShardSet は shards を検証してシャード構成を作ります。
+// 各シャードのDB設定は base のホストだけを差し替えたものになり、Address を省略したシャードはDBのホストに向ける。
+func newDNSShardSet(base *mysql.Config, shards []DNSUserShard) (*dnsShardSet, error) {
+	if base == nil {
+		base = mysql.NewConfig()
+	}
+	_, port, err := net.SplitHostPort(base.Addr)
+	if err != nil {
+		port = "3306"
+	}
+	set := &dnsShardSet{}
+	var weightSum int64
+	for _, shard := range shards {
+		if net.ParseIP(shard.Host) == nil {
+			return nil, fmt.Errorf("shard host must be an ip address: %s", shard.Host)
+		}
+		if shard.Address == "" {
+			shard.Address = shard.Host
+		}
+		if net.ParseIP(shard.Address) == nil {
+			return nil, fmt.Errorf("shard address must be an ip address: %s", shard.Address)
+		}
+		if shard.Weight < 0 {
+			return nil, fmt.Errorf("shard weight must not be negative: %s", shard.Name)
+		}
+		conf := base.Clone()
+		conf.Addr = net.JoinHostPort(shard.Host, port)
+		set.shards = append(set.shards, shard)
+		set.configs = append(set.configs, &isuutil.ShardConfig{
+			DisplayName: shard.Name,
+			MySQLConfig: conf,
+			Weight:      isuutil.Weight(shard.Weight),
+		})
+		weightSum += shard.Weight
+	}
+	if len(shards) > 0 && weightSum == 0 {
+		return nil, fmt.Errorf("at least one shard must have a positive weight")
+	}
+	return set, nil
+}
+
+// SetShards はシャード構成を差し替えます。空にすると全ユーザを powerDNSSubdomainAddress に向ける。
+func (r *dnsShardRouter) SetShards(set *dnsShardSet) {
+	r.set.Store(set)
+}
+
+// Shards は Address を補ったシャード構成を返します
+func (r *dnsShardRouter) Shards() []DNSUserShard {
+	if set := r.set.Load(); set != nil && set.shards != nil {
+		return set.shards
+	}
+	return []DNSUserShard{}
+}
+
+func (r *dnsShardRouter) SetUserID(name string, id int64) {
+	r.AddUserIDs(map[string]int64{name: id})
+}
+
+// AddUserIDs は userIDs の対応を追加します。既にある他の名前の対応は残す。
+func (r *dnsShardRouter) AddUserIDs(userIDs map[string]int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur := *r.userIDs.Load()
+	changed := false
+	for name, id := range userIDs {
+		if v, ok := cur[name]; !ok || v != id {
+			changed = true
+			break
+		}
+	}
+	// ポーリングで読み直した名前は既にあるので、コピーせずに済ませる
+	if !changed {
+		return
+	}
+	next := maps.Clone(cur)
+	maps.Copy(next, userIDs)
+	r.userIDs.Store(&next)
+}
+
+// ResetUserIDs はユーザ名とIDの対応を userIDs で置き換えます
+func (r *dnsShardRouter) ResetUserIDs(userIDs map[string]int64) {
+	userIDs = maps.Clone(userIDs)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.userIDs.Store(&userIDs)
+}
+
+// Address は name のユーザのデータを持つシャードのアプリのアドレスを返します。
+// シャードが設定されていない場合や、ゾーンファイルにだけある名前などIDが分からない場合は powerDNSSubdomainAddress を返す。
+func (r *dnsShardRouter) Address(name string) string {
+	set := r.set.Load()
+	if set == nil || len(set.shards) == 0 {
+		return powerDNSSubdomainAddress
+	}
+	id, ok := (*r.userIDs.Load())[name]
+	if !ok {
+		return powerDNSSubdomainAddress
+	}
+	return set.shards[isuutil.ShardIndex(set.configs, id)].Address
+}
+
+// DNSUserShard はシャードの設定です。Host はDBのホストで、Address はDNSで応答するアプリのアドレス。
+type DNSUserShard struct {
+	Name    string `json:"name"`
+	Host    string `json:"host"`
+	Address string `json:"address,omitempty"`
+	Weight  int64  `json:"weight"`
+}
+
+// PublishShards は更新したシャード構成をすべてのピアに伝えます。
+// シャード構成はポーリングで追いつかないので、失敗したピアがあれば呼び出し元に返してやり直してもらう。
+func (s *dnsSyncer) PublishShards(ctx context.Context, shards []DNSUserShard) error {
+	return s.broadcast(ctx, dnsSyncShardsPath, shards)
+}
+
+// applyShards はシャード構成を差し替え、ゾーンのシリアルを進めてセカンダリにも反映させます
+func (s *dnsSyncer) applyShards(c echo.Context) (*dnsShardSet, error) {
+	defer c.Request().Body.Close()
+
+	var req []DNSUserShard
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	set, err := newDNSShardSet(dbConfig, req)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	s.shards.SetShards(set)
+	s.names.Invalidate()
+	return set, nil
+}
+
+// DNSの振り分けに使うシャード構成の取得API
+// GET /api/internal/dns/shards
+func (s *dnsSyncer) getShardsHandler(c echo.Context) error {
+	if err := s.authorize(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.shards.Shards())
+}
+
+// DNSの振り分けに使うシャード構成の更新API
+// シャードを増減したときにどれか1つのノードに対して呼ぶと、すべてのピアに伝搬する。
+// 再起動すると環境変数の構成に戻るので、恒久的に変えるときは環境変数も合わせて更新する。
+// PUT /api/internal/dns/shards
+func (s *dnsSyncer) putShardsHandler(c echo.Context) error {
+	if err := s.authorize(c); err != nil {
+		return err
+	}
+	set, err := s.applyShards(c)
+	if err != nil {
+		return err
+	}
+	// 同じ構成のPUTは冪等なので、ピアに伝わらなければやり直せばよい
+	if err := s.PublishShards(c.Request().Context(), set.shards); err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to publish dns shards to peers: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, set.shards)
+}
+
+// ピアで更新されたシャード構成を取り込むAPI
+// POST /api/internal/dns/shards/sync
+func (s *dnsSyncer) shardsHandler(c echo.Context) error {
+	if err := s.authorize(c); err != nil {
+		return err
+	}
+	if _, err := s.applyShards(c); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
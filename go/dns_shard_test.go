@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/isucon/isucon13/webapp/go/isuutil"
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+func TestDNSShardRouter(t *testing.T) {
+	prevShards := userShards
+	t.Cleanup(func() { userShards = prevShards })
+	userShards = newDNSShardRouter()
+
+	udpAddr, _ := startTestDNSServer(t, testZone)
+
+	// s3 はDBとアプリが別のホストにある
+	set, err := newDNSShardSet(nil, []DNSUserShard{
+		{Name: "s1", Host: "192.0.2.11", Weight: 0},
+		{Name: "s2", Host: "192.0.2.12", Weight: 1},
+		{Name: "s3", Host: "192.0.2.13", Address: "198.51.100.13", Weight: 4},
+	})
+	if err != nil {
+		t.Fatalf("failed to create shard configs: %v", err)
+	}
+	userShards.SetShards(set)
+
+	resolve := func(name string) string {
+		m := new(dns.Msg)
+		m.SetQuestion(name+".u.isucon.dev.", dns.TypeA)
+		r := exchange(t, "udp", udpAddr, m)
+		if len(r.Answer) != 1 {
+			t.Fatalf("%s: want 1 answer, got %v", name, r.Answer)
+		}
+		return r.Answer[0].(*dns.A).A.String()
+	}
+
+	for id := int64(1); id <= 20; id++ {
+		name := fmt.Sprintf("user%d", id)
+		userShards.SetUserID(name, id)
+		userNames.Add(name)
+
+		want := map[int]string{1: "192.0.2.12", 2: "198.51.100.13"}[isuutil.ShardIndex(set.configs, id)]
+		if got := resolve(name); got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+
+	// IDの分からないゾーンファイルの名前は従来のアドレスのまま
+	if got := resolve("www"); got != powerDNSSubdomainAddress {
+		t.Errorf("www: want %s, got %s", powerDNSSubdomainAddress, got)
+	}
+
+	// シャード構成を変えると応答も変わり、シリアルが進む
+	set, err = newDNSShardSet(nil, []DNSUserShard{{Name: "s4", Host: "192.0.2.14", Weight: 1}})
+	if err != nil {
+		t.Fatalf("failed to create shard configs: %v", err)
+	}
+	serial := userNames.Serial()
+	userShards.SetShards(set)
+	userNames.Invalidate()
+	if got := resolve("user1"); got != "192.0.2.14" {
+		t.Errorf("user1: want 192.0.2.14 after resharding, got %s", got)
+	}
+	if userNames.Serial() == serial {
+		t.Errorf("serial must advance on resharding")
+	}
+	if _, ok := userNames.Changes(serial); ok {
+		t.Errorf("ixfr must fall back to axfr after resharding")
+	}
+}
+
+func TestUserShardsFromEnv(t *testing.T) {
+	t.Setenv(userShardsEnvKey, "192.0.2.11:1, 192.0.2.12:4:198.51.100.12")
+	shards, err := userShardsFromEnv()
+	if err != nil {
+		t.Fatalf("failed to load shards: %v", err)
+	}
+	want := []DNSUserShard{
+		{Name: "192.0.2.11", Host: "192.0.2.11", Weight: 1},
+		{Name: "192.0.2.12", Host: "192.0.2.12", Address: "198.51.100.12", Weight: 4},
+	}
+	if !slices.Equal(shards, want) {
+		t.Errorf("want %v, got %v", want, shards)
+	}
+
+	t.Setenv(userShardsEnvKey, "192.0.2.11:1:198.51.100.11:x")
+	if _, err := userShardsFromEnv(); err == nil {
+		t.Errorf("too many fields must be rejected")
+	}
+}
+
+func TestDNSSyncer_PutShards(t *testing.T) {
+	nodes := []*dnsSyncTestNode{newDNSSyncTestNode(t, "secret"), newDNSSyncTestNode(t, "secret"), newDNSSyncTestNode(t, "secret")}
+	for _, node := range nodes {
+		for _, peer := range nodes {
+			if peer != node {
+				node.syncer.peers = append(node.syncer.peers, peer.server.URL)
+			}
+		}
+	}
+
+	body := `[{"name":"s1","host":"192.0.2.11","address":"198.51.100.11","weight":1}]`
+	req, err := http.NewRequest(http.MethodPut, nodes[0].server.URL+dnsShardsPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(internalTokenHeader, "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to put shards: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+
+	// どのノードで受けても、すべてのノードが同じアドレスに向ける
+	for i, node := range nodes {
+		node.syncer.shards.SetUserID("alice", 1)
+		if got := node.syncer.shards.Address("alice"); got != "198.51.100.11" {
+			t.Errorf("node %d: want 198.51.100.11, got %s", i, got)
+		}
+	}
+}
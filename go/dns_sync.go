@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+// 登録されたユーザ名を全ノードのDNSキャッシュに伝搬させるための仕組み。
+// nginxは /api/register をs1に、それ以外を別ノードに振り分けるので、ノード間でサブドメインの集合が食い違ってしまう。
+// そこで、登録を受けたノードがピアに名前をpushし、取りこぼしはMySQLのポーリングで拾う。
+const (
+	dnsSyncPeersEnvKey    = "ISUCON13_DNS_SYNC_PEERS"
+	dnsSyncTokenEnvKey    = "ISUCON13_DNS_SYNC_TOKEN"
+	dnsSyncIntervalEnvKey = "ISUCON13_DNS_SYNC_INTERVAL"
+
+	dnsSyncNamesPath  = "/api/internal/dns/names"
+	dnsSyncReloadPath = "/api/internal/dns/reload"
+
+	internalTokenHeader = "X-Isupipe-Internal-Token"
+
+	defaultDNSSyncInterval = 1 * time.Second
+	dnsSyncPushTimeout     = 1 * time.Second
+
+	// dnsSyncRescanWindow は取り込み済みの最大IDより手前を読み直す件数です。
+	// AUTO_INCREMENT のIDはコミット前に払い出されるので、同時に登録されるとIDの小さいユーザが後から見えることがある。
+	dnsSyncRescanWindow = 100
+)
+
+var dnsSync = newDNSSyncerFromEnv(userNames, userShards)
+
+type DNSSyncUser struct {
+	ID   int64  `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+}
+
+type DNSSyncNamesRequest struct {
+	Users []DNSSyncUser `json:"users"`
+}
+
+// dnsSyncer はピアとの間でDNSのサブドメイン集合を同期します
+type dnsSyncer struct {
+	names  *dnsNames
+	shards *dnsShardRouter
+	peers  []string
+	token  string
+	client *http.Client
+
+	// reload はピアから再読み込みを要求されたときに呼ばれます。nilなら initializeDnsCache を使う。
+	reload func() error
+	// users はポーリングでユーザを読む先です
+	users dnsUserSource
+
+	// lastUserID はポーリングで取り込み済みの最大のユーザID、userCount はそのときのユーザ数
+	lastUserID atomic.Int64
+	userCount  atomic.Int64
+	pollMu     sync.Mutex
+}
+
+func newDNSSyncer(names *dnsNames, shards *dnsShardRouter, peers []string, token string) *dnsSyncer {
+	return &dnsSyncer{
+		names:  names,
+		shards: shards,
+		peers:  peers,
+		token:  token,
+		client: &http.Client{Timeout: dnsSyncPushTimeout},
+		users:  dbUserSource{},
+	}
+}
+
+// dnsUserSource はポーリングでユーザを読む先です。テストではDBの代わりを渡す。
+type dnsUserSource interface {
+	// Stat は最大のユーザIDとユーザ数を返します
+	Stat(ctx context.Context) (maxID int64, count int64, err error)
+	// UsersAfter は id より大きいIDのユーザをID順に返します
+	UsersAfter(ctx context.Context, id int64) ([]DNSSyncUser, error)
+}
+
+// dbUserSource は users テーブルを読みます
+type dbUserSource struct{}
+
+func (dbUserSource) Stat(ctx context.Context) (int64, int64, error) {
+	var stat struct {
+		MaxID int64 `db:"max_id"`
+		Count int64 `db:"count"`
+	}
+	if err := dbConn.GetContext(ctx, &stat, "SELECT COALESCE(MAX(id), 0) AS max_id, COUNT(*) AS count FROM users"); err != nil {
+		return 0, 0, fmt.Errorf("failed to get max user id: %w", err)
+	}
+	return stat.MaxID, stat.Count, nil
+}
+
+func (dbUserSource) UsersAfter(ctx context.Context, id int64) ([]DNSSyncUser, error) {
+	var users []DNSSyncUser
+	if err := dbConn.SelectContext(ctx, &users, "SELECT id, name FROM users WHERE id > ? ORDER BY id", id); err != nil {
+		return nil, fmt.Errorf("failed to select users: %w", err)
+	}
+	return users, nil
+}
+
+// newDNSSyncerFromEnv は環境変数からピアと共有トークンを読み込みます。
+// ピアは "http://192.168.0.11:8080,http://192.168.0.13:8080" のようにカンマ区切りで指定します。
+func newDNSSyncerFromEnv(names *dnsNames, shards *dnsShardRouter) *dnsSyncer {
+	var peers []string
+	for _, peer := range strings.Split(os.Getenv(dnsSyncPeersEnvKey), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, strings.TrimSuffix(peer, "/"))
+		}
+	}
+	return newDNSSyncer(names, shards, peers, os.Getenv(dnsSyncTokenEnvKey))
+}
+
+func dnsSyncIntervalFromEnv() (time.Duration, error) {
+	v, ok := os.LookupEnv(dnsSyncIntervalEnvKey)
+	if !ok {
+		return defaultDNSSyncInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse environment variable '%s' as duration: %w", dnsSyncIntervalEnvKey, err)
+	}
+	return d, nil
+}
+
+// Publish は新しく登録されたユーザをすべてのピアにpushします。
+// 失敗したピアはポーリングで追いつくので、エラーは返すがリトライはしない。
+func (s *dnsSyncer) Publish(ctx context.Context, users ...DNSSyncUser) error {
+	return s.broadcast(ctx, dnsSyncNamesPath, &DNSSyncNamesRequest{Users: users})
+}
+
+// addUser はユーザをDNSで応答する集合に加えます
+func (s *dnsSyncer) addUser(id int64, name string) {
+	s.shards.SetUserID(name, id)
+	s.names.Add(name)
+}
+
+// Reload はすべてのピアにDNSキャッシュの再構築を要求します。
+// initializeはs1にしか来ないので、他のノードにはこれで伝える。
+func (s *dnsSyncer) Reload(ctx context.Context) error {
+	return s.broadcast(ctx, dnsSyncReloadPath, struct{}{})
+}
+
+func (s *dnsSyncer) broadcast(ctx context.Context, path string, body any) error {
+	if len(s.peers) == 0 || s.token == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return callPeers(ctx, s.client, s.peers, s.token, http.MethodPost, path, echo.MIMEApplicationJSON, b)
+}
+
+// callPeers はすべてのピアの内部APIを並行して呼び出します。
+// 204以外を返したピアがあればエラーを返すが、他のピアへの呼び出しは止めない。
+func callPeers(ctx context.Context, client *http.Client, peers []string, token string, method string, path string, contentType string, body []byte) error {
+	if len(peers) == 0 || token == "" {
+		return nil
+	}
+
+	var eg errgroup.Group
+	for _, peer := range peers {
+		peer := peer
+		eg.Go(func() error {
+			req, err := http.NewRequestWithContext(ctx, method, peer+path, bytes.NewReader(body))
+			if err != nil {
+				return fmt.Errorf("failed to create request to %s: %w", peer, err)
+			}
+			req.Header.Set(echo.HeaderContentType, contentType)
+			req.Header.Set(internalTokenHeader, token)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("failed to send request to %s: %w", peer, err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				return fmt.Errorf("unexpected status from %s: %d", peer, resp.StatusCode)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+func (s *dnsSyncer) authorize(c echo.Context) error {
+	return verifyInternalToken(c, s.token)
+}
+
+// verifyInternalToken はノード間の内部APIの呼び出し元を共有トークンで検証します。
+// /api 以下はnginxから外部に公開されているので、トークンが設定されていない場合は常に拒否する。
+func verifyInternalToken(c echo.Context, token string) error {
+	if token == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "internal api is disabled")
+	}
+	got := c.Request().Header.Get(internalTokenHeader)
+	if got == "" {
+		// Prometheusなどヘッダを自由に付けられないクライアントのため、Bearerトークンも受け付ける
+		got, _ = strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid internal token")
+	}
+	return nil
+}
+
+// ピアからpushされた名前を取り込むAPI
+// POST /api/internal/dns/names
+func (s *dnsSyncer) namesHandler(c echo.Context) error {
+	if err := s.authorize(c); err != nil {
+		return err
+	}
+	defer c.Request().Body.Close()
+
+	req := DNSSyncNamesRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	for _, user := range req.Users {
+		s.addUser(user.ID, user.Name)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ピアからDNSキャッシュの再構築を要求されるAPI
+// POST /api/internal/dns/reload
+func (s *dnsSyncer) reloadHandler(c echo.Context) error {
+	if err := s.authorize(c); err != nil {
+		return err
+	}
+	if err := s.doReload(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload dns cache: "+err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *dnsSyncer) doReload() error {
+	if s.reload != nil {
+		return s.reload()
+	}
+	return initializeDnsCache(false)
+}
+
+func (s *dnsSyncer) setPolled(lastUserID int64, userCount int64) {
+	s.lastUserID.Store(lastUserID)
+	s.userCount.Store(userCount)
+}
+
+// Poll はMySQLから未取り込みのユーザ名を取り込みます。
+// pushが届かなかった場合でも、ポーリング間隔以内に全ノードの集合が収束する。
+// 最大のIDが変わらなくても件数が増えていれば、後からコミットされたユーザがいるので読み直す。
+// 読み直した範囲で増えた件数の分を見つけられなければ、窓より前にあるので全体を読み直す。
+func (s *dnsSyncer) Poll(ctx context.Context) error {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+
+	maxID, count, err := s.users.Stat(ctx)
+	if err != nil {
+		return err
+	}
+
+	lastUserID := s.lastUserID.Load()
+	userCount := s.userCount.Load()
+	if maxID == lastUserID && count == userCount {
+		return nil
+	}
+	if maxID < lastUserID {
+		// 別ノードでinitializeされてusersがTRUNCATEされた
+		return s.doReload()
+	}
+
+	users, err := s.users.UsersAfter(ctx, lastUserID-dnsSyncRescanWindow)
+	if err != nil {
+		return err
+	}
+	if s.addUsers(users) < count-userCount {
+		users, err = s.users.UsersAfter(ctx, 0)
+		if err != nil {
+			return err
+		}
+		s.addUsers(users)
+	}
+	for _, user := range users {
+		lastUserID = max(lastUserID, user.ID)
+	}
+	s.setPolled(lastUserID, count)
+
+	return nil
+}
+
+// addUsers は users を取り込み、新しく加わった件数を返します。
+// 名前の追加は冪等なので、取り込み済みのユーザが含まれていても構わない。
+func (s *dnsSyncer) addUsers(users []DNSSyncUser) int64 {
+	var added int64
+	for _, user := range users {
+		if !s.names.Has(user.Name) {
+			added++
+		}
+		s.addUser(user.ID, user.Name)
+	}
+	return added
+}
+
+// RunPoller は interval ごとに Poll を実行します。
+// goroutineで動かすことが想定されています。
+func (s *dnsSyncer) RunPoller(interval time.Duration, logger echo.Logger) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := s.Poll(context.Background()); err != nil {
+			logger.Warnf("failed to poll dns names: %v", err)
+		}
+	}
+}
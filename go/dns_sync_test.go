@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+type dnsSyncTestNode struct {
+	names  *dnsNames
+	syncer *dnsSyncer
+	server *httptest.Server
+}
+
+func newDNSSyncTestNode(t *testing.T, token string) *dnsSyncTestNode {
+	t.Helper()
+
+	names := newDNSNames()
+	syncer := newDNSSyncer(names, newDNSShardRouter(), nil, token)
+
+	e := echo.New()
+	e.POST(dnsSyncNamesPath, syncer.namesHandler)
+	e.POST(dnsSyncReloadPath, syncer.reloadHandler)
+	e.PUT(dnsShardsPath, syncer.putShardsHandler)
+	e.POST(dnsSyncShardsPath, syncer.shardsHandler)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return &dnsSyncTestNode{names: names, syncer: syncer, server: server}
+}
+
+func TestDNSSyncer_Publish(t *testing.T) {
+	s1 := newDNSSyncTestNode(t, "secret")
+	s2 := newDNSSyncTestNode(t, "secret")
+	s1.syncer.peers = []string{s2.server.URL}
+	s2.syncer.peers = []string{s1.server.URL}
+
+	// s1で登録されたものとする
+	s1.names.Add("alice")
+	if err := s1.syncer.Publish(context.Background(), DNSSyncUser{ID: 1, Name: "alice"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	if !s2.names.Has("alice") {
+		t.Errorf("alice is not propagated to s2")
+	}
+	if s2.names.Has("bob") {
+		t.Errorf("bob must not exist on s2")
+	}
+}
+
+func TestDNSSyncer_Reload(t *testing.T) {
+	s1 := newDNSSyncTestNode(t, "secret")
+	s2 := newDNSSyncTestNode(t, "secret")
+	s1.syncer.peers = []string{s2.server.URL}
+
+	s2.names.Add("alice")
+	s2.syncer.reload = func() error {
+		s2.names.Reset(nil)
+		return nil
+	}
+
+	if err := s1.syncer.Reload(context.Background()); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if s2.names.Has("alice") {
+		t.Errorf("s2 is not reloaded")
+	}
+}
+
+func TestDNSSyncer_RejectsInvalidToken(t *testing.T) {
+	s1 := newDNSSyncTestNode(t, "secret")
+	s2 := newDNSSyncTestNode(t, "another")
+	s1.syncer.peers = []string{s2.server.URL}
+
+	if err := s1.syncer.Publish(context.Background(), DNSSyncUser{ID: 1, Name: "alice"}); err == nil {
+		t.Errorf("publish must fail with an invalid token")
+	}
+	if s2.names.Has("alice") {
+		t.Errorf("alice must not be propagated with an invalid token")
+	}
+
+	// トークン無しでも弾かれる
+	resp, err := http.Post(s2.server.URL+dnsSyncNamesPath, echo.MIMEApplicationJSON, strings.NewReader(`{"names":["bob"]}`))
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if s2.names.Has("bob") {
+		t.Errorf("bob must not be added without a token")
+	}
+}
+
+// testUserSource は users テーブルの代わりです
+type testUserSource struct {
+	users []DNSSyncUser
+}
+
+func (s *testUserSource) Stat(context.Context) (int64, int64, error) {
+	var maxID int64
+	for _, user := range s.users {
+		maxID = max(maxID, user.ID)
+	}
+	return maxID, int64(len(s.users)), nil
+}
+
+func (s *testUserSource) UsersAfter(_ context.Context, id int64) ([]DNSSyncUser, error) {
+	var users []DNSSyncUser
+	for _, user := range s.users {
+		if user.ID > id {
+			users = append(users, user)
+		}
+	}
+	slices.SortFunc(users, func(a, b DNSSyncUser) int { return cmp.Compare(a.ID, b.ID) })
+	return users, nil
+}
+
+func TestDNSSyncer_PollLateCommit(t *testing.T) {
+	node := newDNSSyncTestNode(t, "secret")
+	source := &testUserSource{}
+	node.syncer.users = source
+
+	late := DNSSyncUser{ID: 10, Name: "late"}
+	for id := int64(1); id <= dnsSyncRescanWindow*2; id++ {
+		if id != late.ID {
+			source.users = append(source.users, DNSSyncUser{ID: id, Name: fmt.Sprintf("user%d", id)})
+		}
+	}
+	if err := node.syncer.Poll(context.Background()); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if node.names.Len() != len(source.users) {
+		t.Fatalf("want %d names, got %d", len(source.users), node.names.Len())
+	}
+
+	// 最大のIDより窓の件数以上小さいIDのユーザが、後からコミットされる
+	source.users = append(source.users, late)
+	if err := node.syncer.Poll(context.Background()); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if !node.names.Has(late.Name) {
+		t.Errorf("a user committed late below the rescan window must be polled")
+	}
+
+	// 取り込み終えたら、次のポーリングでは何もしない
+	serial := node.names.Serial()
+	if err := node.syncer.Poll(context.Background()); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if node.names.Serial() != serial {
+		t.Errorf("nothing must change once the node has caught up")
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 3600
+@   SOA  ns1 hostmaster.u.isucon.dev. (
+    0      ; serial
+    10800  ; refresh
+    3600   ; retry
+    604800 ; expire
+    3600   ; ncache
+)
+@        0 IN NS  ns1.u.isucon.dev.
+@        0 IN A   192.0.2.1
+ns1      0 IN A   192.0.2.1
+www      0 IN A   192.0.2.1
+`
+
+// startTestDNSServer は echoHandler をUDPとTCPで待ち受けるサーバーを起動し、それぞれのアドレスを返します
+func startTestDNSServer(t *testing.T, zone string) (string, string) {
+	t.Helper()
+	setupTestZone(t, zone)
+	return serveTestDNS(t)
+}
+
+// setupTestZone は zone だけをホストするようにグローバルなゾーンを差し替えます。
+// サーバーが参照するグローバルな設定は、serveTestDNS の前に変えること。
+// t.Cleanup は登録と逆順に呼ばれるので、元に戻すのはサーバーを止めた後になる。
+func setupTestZone(t *testing.T, zone string) *hostedZone {
+	t.Helper()
+
+	z, err := parseZone([]byte(zone), domain, "test")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+	prevZones := hostedZones
+	prevAddr := powerDNSSubdomainAddress
+	prevNames := userNames
+	t.Cleanup(func() {
+		hostedZones = prevZones
+		powerDNSSubdomainAddress = prevAddr
+		userNames = prevNames
+	})
+	powerDNSSubdomainAddress = "192.0.2.1"
+	userNames = newDNSNames()
+	hz, err := newHostedZone(dnsZoneConfig{Name: domain}, true)
+	if err != nil {
+		t.Fatalf("failed to create zone: %v", err)
+	}
+	hz.setFile(z)
+	hostedZones = []*hostedZone{hz}
+	userNames.Add(z.Subdomains...)
+	userNames.Add("alice")
+	return hz
+}
+
+// serveTestDNS は echoHandler をUDPとTCPで待ち受けるサーバーを起動し、それぞれのアドレスを返します
+func serveTestDNS(t *testing.T) (string, string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen udp: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen tcp: %v", err)
+	}
+
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: dns.HandlerFunc(echoHandler), TsigSecret: dnsTsigSecret},
+		{Listener: l, Handler: dns.HandlerFunc(echoHandler), TsigSecret: dnsTsigSecret},
+	} {
+		srv := srv
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+
+	return pc.LocalAddr().String(), l.Addr().String()
+}
+
+func exchange(t *testing.T, network string, addr string, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	c := &dns.Client{Net: network, Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("failed to exchange over %s: %v", network, err)
+	}
+	return r
+}
+
+func TestEchoHandler(t *testing.T) {
+	udpAddr, tcpAddr := startTestDNSServer(t, testZone)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		rcode     int
+		answers   int
+		authority bool
+		aa        bool
+	}{
+		{name: "user A", qname: "alice.u.isucon.dev.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answers: 1, aa: true},
+		{name: "zone A", qname: "www.u.isucon.dev.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answers: 1, aa: true},
+		{name: "mixed case", qname: "ALICE.u.isucon.dev.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answers: 1, aa: true},
+		{name: "apex NS", qname: "u.isucon.dev.", qtype: dns.TypeNS, rcode: dns.RcodeSuccess, answers: 1, aa: true},
+		{name: "apex SOA", qname: "u.isucon.dev.", qtype: dns.TypeSOA, rcode: dns.RcodeSuccess, answers: 1, aa: true},
+		{name: "NODATA", qname: "alice.u.isucon.dev.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, answers: 0, authority: true, aa: true},
+		{name: "NXDOMAIN", qname: "nobody.u.isucon.dev.", qtype: dns.TypeA, rcode: dns.RcodeNameError, answers: 0, authority: true, aa: true},
+		{name: "NXDOMAIN NS", qname: "nobody.u.isucon.dev.", qtype: dns.TypeNS, rcode: dns.RcodeNameError, answers: 0, authority: true, aa: true},
+		{name: "out of zone", qname: "example.com.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+		{name: "suffix only", qname: "xu.isucon.dev.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		addr := udpAddr
+		if network == "tcp" {
+			addr = tcpAddr
+		}
+		for _, tt := range tests {
+			t.Run(network+"/"+tt.name, func(t *testing.T) {
+				m := new(dns.Msg)
+				m.SetQuestion(tt.qname, tt.qtype)
+				r := exchange(t, network, addr, m)
+
+				if r.Rcode != tt.rcode {
+					t.Errorf("want rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[r.Rcode])
+				}
+				if len(r.Answer) != tt.answers {
+					t.Errorf("want %d answers, got %d: %v", tt.answers, len(r.Answer), r.Answer)
+				}
+				for _, rr := range r.Answer {
+					if rr.Header().Name != tt.qname {
+						t.Errorf("want owner %s, got %s", tt.qname, rr.Header().Name)
+					}
+				}
+				if tt.authority {
+					if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+						t.Errorf("want SOA in authority section, got %v", r.Ns)
+					}
+				} else if len(r.Ns) != 0 {
+					t.Errorf("want empty authority section, got %v", r.Ns)
+				}
+				if r.Authoritative != tt.aa {
+					t.Errorf("want AA=%v, got %v", tt.aa, r.Authoritative)
+				}
+				if r.Truncated {
+					t.Errorf("must not be truncated")
+				}
+			})
+		}
+	}
+}
+
+// 1つのクエリに対して応答がちょうど1つだけ返ることを確認する
+func TestEchoHandler_SingleReply(t *testing.T) {
+	udpAddr, _ := startTestDNSServer(t, testZone)
+
+	for _, qname := range []string{"alice.u.isucon.dev.", "nobody.u.isucon.dev."} {
+		conn, err := net.Dial("udp", udpAddr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeA)
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatalf("failed to pack: %v", err)
+		}
+		if _, err := conn.Write(b); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+
+		buf := make([]byte, dns.MaxMsgSize)
+		replies := 0
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			if _, err := conn.Read(buf); err != nil {
+				break
+			}
+			replies++
+		}
+		if replies != 1 {
+			t.Errorf("%s: want exactly 1 reply, got %d", qname, replies)
+		}
+	}
+}
+
+func TestEchoHandler_EDNS0(t *testing.T) {
+	udpAddr, _ := startTestDNSServer(t, testZone)
+
+	m := new(dns.Msg)
+	m.SetQuestion("alice.u.isucon.dev.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	r := exchange(t, "udp", udpAddr, m)
+
+	opt := r.IsEdns0()
+	if opt == nil {
+		t.Fatalf("want OPT record in reply")
+	}
+	if opt.UDPSize() != maxUDPPayloadSize {
+		t.Errorf("want udp size %d, got %d", maxUDPPayloadSize, opt.UDPSize())
+	}
+	if !opt.Do() {
+		t.Errorf("want DO bit to be echoed")
+	}
+
+	// 問い合わせにOPTが無ければ応答にも付けない
+	m = new(dns.Msg)
+	m.SetQuestion("alice.u.isucon.dev.", dns.TypeA)
+	r = exchange(t, "udp", udpAddr, m)
+	if r.IsEdns0() != nil {
+		t.Errorf("want no OPT record in reply")
+	}
+
+	// 未対応のEDNSバージョンにはBADVERSを返す
+	m = new(dns.Msg)
+	m.SetQuestion("alice.u.isucon.dev.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().SetVersion(1)
+	r = exchange(t, "udp", udpAddr, m)
+	if r.Rcode != dns.RcodeBadVers {
+		t.Errorf("want rcode BADVERS, got %s", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestEchoHandler_Truncate(t *testing.T) {
+	// 512バイトに収まらないTXTレコードを用意する
+	var txt []string
+	for i := 0; i < 15; i++ {
+		txt = append(txt, fmt.Sprintf("%q", strings.Repeat(fmt.Sprint(i%10), 60)))
+	}
+	zone := testZone + "big 0 IN TXT " + strings.Join(txt, " ") + "\n"
+	udpAddr, tcpAddr := startTestDNSServer(t, zone)
+
+	m := new(dns.Msg)
+	m.SetQuestion("big.u.isucon.dev.", dns.TypeTXT)
+
+	r := exchange(t, "udp", udpAddr, m)
+	if !r.Truncated {
+		t.Errorf("want TC bit over udp")
+	}
+	if r.Len() > dns.MinMsgSize {
+		t.Errorf("reply exceeds %d bytes: %d", dns.MinMsgSize, r.Len())
+	}
+
+	// EDNS0でバッファを広げれば切り詰められない
+	m.SetEdns0(4096, false)
+	r = exchange(t, "udp", udpAddr, m)
+	if r.Truncated {
+		t.Errorf("must not be truncated with edns0 buffer")
+	}
+
+	// TCPなら全て返る
+	m = new(dns.Msg)
+	m.SetQuestion("big.u.isucon.dev.", dns.TypeTXT)
+	r = exchange(t, "tcp", tcpAddr, m)
+	if r.Truncated || len(r.Answer) != 1 {
+		t.Errorf("want full answer over tcp, got truncated=%v answers=%d", r.Truncated, len(r.Answer))
+	}
+}
+
+func TestDNSNames_Has(t *testing.T) {
+	n := newDNSNames()
+	var names []string
+	for i := 0; i < 3000; i++ {
+		names = append(names, fmt.Sprintf("user%d", i))
+	}
+	n.Reset(names[:1000])
+	// 1件ずつの追加と、フィルタを作り直すほどの追加を混ぜる
+	for _, name := range names[1000:1010] {
+		n.Add(name)
+	}
+	n.Add(names[1010:]...)
+
+	for _, name := range names {
+		if !n.Has(name) {
+			t.Fatalf("%s must exist", name)
+		}
+	}
+	for i := 0; i < 3000; i++ {
+		if name := fmt.Sprintf("nobody%d", i); n.Has(name) {
+			t.Fatalf("%s must not exist", name)
+		}
+	}
+	if _, snapshot := n.Snapshot(); len(snapshot) != len(names) || !slices.IsSorted(snapshot) {
+		t.Errorf("snapshot must be sorted and contain all names")
+	}
+
+	n.Reset(names[:1])
+	if n.Has(names[1]) || !n.Has(names[0]) {
+		t.Errorf("reset must replace the set")
+	}
+}
+
+// mapDNSNames は以前の map と RWMutex による実装で、ベンチマークの比較用です
+type mapDNSNames struct {
+	mu    sync.RWMutex
+	names map[string]bool
+}
+
+func (n *mapDNSNames) Has(name string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.names[name]
+}
+
+func (n *mapDNSNames) Add(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.names[name] = true
+}
+
+const benchmarkDNSNames = 100000
+
+// benchmarkNamesHas は登録済みの名前と存在しない名前を半々に並列で引きます。
+// 登録が続く状況を再現するため、別のgoroutineで少しずつ名前を追加する。
+func benchmarkNamesHas(b *testing.B, has func(string) bool, add func(string)) {
+	queries := make([]string, 1024)
+	for i := range queries {
+		if i%2 == 0 {
+			queries[i] = fmt.Sprintf("user%d", i*97%benchmarkDNSNames)
+		} else {
+			queries[i] = fmt.Sprintf("random%d", i)
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				add(fmt.Sprintf("new%d", i))
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			has(queries[i%len(queries)])
+			i++
+		}
+	})
+}
+
+func BenchmarkDNSNames_Has(b *testing.B) {
+	names := make([]string, 0, benchmarkDNSNames)
+	for i := 0; i < benchmarkDNSNames; i++ {
+		names = append(names, fmt.Sprintf("user%d", i))
+	}
+
+	b.Run("map", func(b *testing.B) {
+		n := &mapDNSNames{names: map[string]bool{}}
+		for _, name := range names {
+			n.Add(name)
+		}
+		benchmarkNamesHas(b, n.Has, n.Add)
+	})
+	b.Run("snapshot", func(b *testing.B) {
+		n := newDNSNames()
+		n.Reset(names)
+		benchmarkNamesHas(b, n.Has, func(name string) { n.Add(name) })
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ゾーン転送 (AXFR/IXFR)。
+// このDNSサーバーを隠しプライマリにして、PowerDNSやBINDのセカンダリから静的なゾーンと登録済みのユーザ名を引かせる。
+// 転送は許可されたアドレスか、TSIGで署名された要求にだけ応じる。
+const (
+	dnsXfrAllowEnvKey = "ISUCON13_DNS_XFR_ALLOW"
+	dnsXfrTsigEnvKey  = "ISUCON13_DNS_XFR_TSIG"
+
+	// 1メッセージに詰めるレコード数。TCPの64KiBに収まるようにする。
+	dnsXfrRecordsPerMessage = 500
+)
+
+var (
+	// dnsXfrAllowNets は転送を許可する送信元です
+	dnsXfrAllowNets []*net.IPNet
+	// dnsTsigSecret はTSIGの鍵名 (FQDN) からbase64の鍵への対応で、dns.Server に渡して検証と署名をさせる
+	dnsTsigSecret = map[string]string{}
+)
+
+// init は許可する送信元と TSIG 鍵を読み込みます。
+// ISUCON13_DNS_XFR_ALLOW は "192.0.2.0/24,198.51.100.1" のようなカンマ区切り、
+// ISUCON13_DNS_XFR_TSIG は "鍵名:base64の鍵" の形式で、アルゴリズムは hmac-sha256 とする。
+func init() {
+	for _, s := range strings.Split(os.Getenv(dnsXfrAllowEnvKey), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		if _, ipnet, err := net.ParseCIDR(s); err == nil {
+			dnsXfrAllowNets = append(dnsXfrAllowNets, ipnet)
+		}
+	}
+	if name, secret, ok := strings.Cut(os.Getenv(dnsXfrTsigEnvKey), ":"); ok {
+		dnsTsigSecret[dns.Fqdn(name)] = secret
+	}
+}
+
+// xfrAllowed は w からのゾーン転送を許可するかを判定します
+func xfrAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if t := r.IsTsig(); t != nil {
+		// 署名の検証は dns.Server が済ませている
+		return w.TsigStatus() == nil && t.Algorithm == dns.HmacSHA256
+	}
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	for _, ipnet := range dnsXfrAllowNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isZoneTransfer は r がゾーン転送の要求かどうかを返します
+func isZoneTransfer(r *dns.Msg) bool {
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		return false
+	}
+	qtype := r.Question[0].Qtype
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// transferHandler はAXFR/IXFRに応答します
+func transferHandler(w dns.ResponseWriter, r *dns.Msg) {
+	rrs, m := buildTransfer(w, r)
+	if m != nil {
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tr.Out(w, r, ch)
+	}()
+	for len(rrs) > 0 {
+		n := min(len(rrs), dnsXfrRecordsPerMessage)
+		ch <- &dns.Envelope{RR: rrs[:n]}
+		rrs = rrs[n:]
+	}
+	close(ch)
+	if err := <-errCh; err != nil {
+		//log.Printf("[ERR] failed to transfer zone: %v", err)
+	}
+	_ = w.Close()
+}
+
+// buildTransfer は転送するレコードを組み立てます。
+// 拒否する場合やUDPで1つのメッセージに収める場合は、その応答を m に返す。
+// panicした場合は buildReply と同じくSERVFAILを返す。
+func buildTransfer(w dns.ResponseWriter, r *dns.Msg) (rrs []dns.RR, m *dns.Msg) {
+	defer servFailOnPanic(r, &m)
+
+	q := r.Question[0]
+	zone, subDomain, ok := findZone(q.Name)
+	if !ok || subDomain != "" || !xfrAllowed(w, r) {
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return nil, m
+	}
+
+	serial, names := zone.names.Snapshot()
+	soa := *zone.file.Load().SOA
+	soa.Serial = serial
+
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	switch {
+	case q.Qtype == dns.TypeAXFR && !isTCP:
+		// AXFRはTCPでしか行わない
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return nil, m
+	case q.Qtype == dns.TypeIXFR:
+		rrs = incrementalTransfer(zone, &soa, r)
+		if rrs == nil {
+			rrs = fullTransfer(zone, &soa, names)
+		}
+		if !isTCP {
+			// UDPで差分が収まらない場合はSOAだけ返し、TCPで問い合わせ直させる (RFC 1995 §2)
+			m = new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			m.Answer = rrs
+			if m.Len() > dns.MinMsgSize {
+				m.Answer = []dns.RR{&soa}
+			}
+			return nil, m
+		}
+	default:
+		rrs = fullTransfer(zone, &soa, names)
+	}
+	return rrs, nil
+}
+
+// fullTransfer はAXFR形式でゾーン全体を返します。
+// SOAで始まりSOAで終わり、間にゾーンファイルのレコードとユーザ名から合成したレコードを入れる。
+func fullTransfer(zone *hostedZone, soa *dns.SOA, names []string) []dns.RR {
+	rrs := []dns.RR{soa}
+	for _, rr := range zone.file.Load().Records {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	for _, name := range names {
+		rrs = append(rrs, userRecords(zone, name)...)
+	}
+	return append(rrs, soa)
+}
+
+// incrementalTransfer はIXFR形式で問い合わせのシリアルからの差分を返します。
+// 差分の記録が残っていない場合は nil を返すので、呼び出し側でAXFR形式にすること。
+func incrementalTransfer(zone *hostedZone, soa *dns.SOA, r *dns.Msg) []dns.RR {
+	var clientSOA *dns.SOA
+	for _, rr := range r.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			clientSOA = s
+			break
+		}
+	}
+	if clientSOA == nil {
+		return nil
+	}
+	entries, ok := zone.names.Changes(clientSOA.Serial)
+	if !ok {
+		return nil
+	}
+	if len(entries) == 0 {
+		// 最新なのでSOAだけ返す
+		return []dns.RR{soa}
+	}
+
+	// Snapshot の後に変更があった場合も、差分の最後のシリアルに合わせる
+	soa.Serial = entries[len(entries)-1].To
+	rrs := []dns.RR{soa}
+	for _, entry := range entries {
+		from := *soa
+		from.Serial = entry.From
+		rrs = append(rrs, &from)
+		rrs = append(rrs, entry.RemovedRecords...)
+		to := *soa
+		to.Serial = entry.To
+		rrs = append(rrs, &to)
+		rrs = append(rrs, entry.AddedRecords...)
+	}
+	return append(rrs, soa)
+}
+
+// userRecords はユーザ名から合成されるレコードを返します。ゾーンファイルにある名前は二重に数えないため空を返す。
+func userRecords(zone *hostedZone, name string) []dns.RR {
+	fqdn := zone.fqdnOf(name)
+	if file := zone.file.Load(); file != nil && len(file.lookup(fqdn)) > 0 {
+		return nil
+	}
+	return synthesizeUserRecords(zone, fqdn, name)
+}
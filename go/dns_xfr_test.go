@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func transferIn(t *testing.T, addr string, m *dns.Msg, tsig map[string]string) ([]dns.RR, error) {
+	t.Helper()
+	tr := &dns.Transfer{TsigSecret: tsig}
+	ch, err := tr.In(m, addr)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs, nil
+}
+
+func allowXfrFrom(t *testing.T, cidr string) {
+	t.Helper()
+	prev := dnsXfrAllowNets
+	t.Cleanup(func() { dnsXfrAllowNets = prev })
+	_, ipnet, _ := net.ParseCIDR(cidr)
+	dnsXfrAllowNets = []*net.IPNet{ipnet}
+}
+
+func TestTransferHandler_AXFR(t *testing.T) {
+	allowXfrFrom(t, "127.0.0.0/8")
+	_, tcpAddr := startTestDNSServer(t, testZone)
+
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(domain))
+	rrs, err := transferIn(t, tcpAddr, m, nil)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+
+	first, ok1 := rrs[0].(*dns.SOA)
+	last, ok2 := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok1 || !ok2 || first.Serial != userNames.Serial() || last.Serial != first.Serial {
+		t.Fatalf("transfer must start and end with the current SOA: %v, %v", rrs[0], rrs[len(rrs)-1])
+	}
+
+	owners := map[string]int{}
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		owners[rr.Header().Name]++
+	}
+	// ゾーンファイルのレコードとユーザ名から合成したレコードが1回ずつ入る
+	for _, name := range []string{"www.u.isucon.dev.", "ns1.u.isucon.dev.", "alice.u.isucon.dev."} {
+		if owners[name] != 1 {
+			t.Errorf("want 1 record for %s, got %d", name, owners[name])
+		}
+	}
+	if owners["u.isucon.dev."] != 2 {
+		t.Errorf("want NS and A for apex, got %d", owners["u.isucon.dev."])
+	}
+}
+
+func TestTransferHandler_IXFR(t *testing.T) {
+	allowXfrFrom(t, "127.0.0.0/8")
+	_, tcpAddr := startTestDNSServer(t, testZone)
+
+	old := userNames.Serial()
+	userNames.Add("bob")
+	userNames.Add("carol")
+	// 削除した名前も、差分には変更した時点のレコードが残る
+	_, names := userNames.Snapshot()
+	userNames.Reset(slices.DeleteFunc(names, func(name string) bool { return name == "bob" }))
+
+	m := new(dns.Msg)
+	m.SetIxfr(dns.Fqdn(domain), old, "ns1.u.isucon.dev.", "hostmaster.u.isucon.dev.")
+	rrs, err := transferIn(t, tcpAddr, m, nil)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+
+	// SOA(new), [SOA(old), 削除, SOA(old+1), 追加] x 3, SOA(new)
+	// sections[i] は i 番目のSOAの後に続くAレコードで、奇数番目が削除、偶数番目が追加になる
+	var serials []uint32
+	var sections [][]string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			serials = append(serials, rr.Serial)
+			sections = append(sections, nil)
+		case *dns.A:
+			if len(sections) == 0 || rr.A.String() != "192.0.2.1" {
+				t.Fatalf("unexpected record: %v", rr)
+			}
+			sections[len(sections)-1] = append(sections[len(sections)-1], rr.Hdr.Name)
+		}
+	}
+	wantSerials := []uint32{old + 3, old, old + 1, old + 1, old + 2, old + 2, old + 3, old + 3}
+	if !slices.Equal(serials, wantSerials) {
+		t.Fatalf("want serials %v, got %v", wantSerials, serials)
+	}
+	wantSections := [][]string{nil, nil, {"bob.u.isucon.dev."}, nil, {"carol.u.isucon.dev."}, {"bob.u.isucon.dev."}, nil, nil}
+	for i := range wantSections {
+		if !slices.Equal(sections[i], wantSections[i]) {
+			t.Errorf("section %d: want %v, got %v", i, wantSections[i], sections[i])
+		}
+	}
+
+	// 最新のシリアルならSOAだけが返る
+	m.SetIxfr(dns.Fqdn(domain), old+3, "ns1.u.isucon.dev.", "hostmaster.u.isucon.dev.")
+	rrs, err = transferIn(t, tcpAddr, m, nil)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	if len(rrs) != 1 {
+		t.Errorf("want only SOA for up-to-date serial, got %d records", len(rrs))
+	}
+}
+
+func TestTransferHandler_Refused(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(domain))
+
+	t.Run("disallowed address", func(t *testing.T) {
+		allowXfrFrom(t, "192.0.2.0/24")
+		_, tcpAddr := startTestDNSServer(t, testZone)
+		if _, err := transferIn(t, tcpAddr, m, nil); err == nil {
+			t.Errorf("transfer must be refused from a disallowed address")
+		}
+	})
+
+	// UDPでのAXFRも拒否する
+	t.Run("udp", func(t *testing.T) {
+		allowXfrFrom(t, "127.0.0.0/8")
+		udpAddr, _ := startTestDNSServer(t, testZone)
+		r := exchange(t, "udp", udpAddr, m)
+		if r.Rcode != dns.RcodeRefused {
+			t.Errorf("want REFUSED over udp, got %s", dns.RcodeToString[r.Rcode])
+		}
+	})
+}
+
+func TestTransferHandler_TSIG(t *testing.T) {
+	const keyName = "xfr."
+	const secret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+	dnsTsigSecret[keyName] = secret
+	t.Cleanup(func() { delete(dnsTsigSecret, keyName) })
+
+	allowXfrFrom(t, "192.0.2.0/24")
+	_, tcpAddr := startTestDNSServer(t, testZone)
+
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(domain))
+	m.SetTsig(keyName, dns.HmacSHA256, 300, 0)
+	rrs, err := transferIn(t, tcpAddr, m, map[string]string{keyName: secret})
+	if err != nil {
+		t.Fatalf("failed to transfer with tsig: %v", err)
+	}
+	if len(rrs) < 2 {
+		t.Errorf("want zone records, got %d", len(rrs))
+	}
+
+	// 鍵が違えば拒否される
+	m.SetTsig(keyName, dns.HmacSHA256, 300, 0)
+	if _, err := transferIn(t, tcpAddr, m, map[string]string{keyName: "d3JvbmdrZXk="}); err == nil {
+		t.Errorf("transfer must be refused with a wrong key")
+	}
+}
+
+func TestTransferHandler_PanicIsServFail(t *testing.T) {
+	allowXfrFrom(t, "192.0.2.0/24")
+	// ゾーンファイルが無いと組み立ての途中でpanicする
+	setupTestZone(t, testZone).file.Store(nil)
+
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(domain))
+	w := &testResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	transferHandler(w, m)
+	if w.written == nil || w.written.Rcode != dns.RcodeServerFailure {
+		t.Errorf("want SERVFAIL, got %v", w.written)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// pdns/init_zone.sh と同じくこの文字列をサブドメインのアドレスに置き換えてから読み込む
+	subdomainAddressPlaceholder = "<ISUCON_SUBDOMAIN_ADDRESS>"
+)
+
+// zoneFile はPowerDNS用のゾーンファイルを読み込んだ結果です。
+// PowerDNSと同じファイルを正とすることで、Goの実装とゾーンの内容が食い違わないようにする。
+type zoneFile struct {
+	SOA     *dns.SOA
+	Records []dns.RR
+	// index は小文字のFQDNからそのレコードを引くためのものです
+	index map[string][]dns.RR
+	// Subdomains はゾーン内に存在するサブドメイン (origin からの相対名) です。apexは含まない。
+	Subdomains []string
+}
+
+// loadZoneFile は path のゾーンファイルを origin のゾーンとして読み込みます。
+// ファイル中の <ISUCON_SUBDOMAIN_ADDRESS> は address に置き換えられます。
+func loadZoneFile(path string, origin string, address string) (*zoneFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+	b = bytes.ReplaceAll(b, []byte(subdomainAddressPlaceholder), []byte(address))
+
+	return parseZone(b, origin, path)
+}
+
+func parseZone(b []byte, origin string, filename string) (*zoneFile, error) {
+	origin = dns.Fqdn(origin)
+	zone := &zoneFile{index: map[string][]dns.RR{}}
+	seen := map[string]bool{}
+
+	zp := dns.NewZoneParser(bytes.NewReader(b), origin, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("record %q is out of zone %s", rr.Header().Name, origin)
+		}
+		if !acceptZoneRecord(rr, origin) {
+			continue
+		}
+		zone.Records = append(zone.Records, rr)
+		zone.index[name] = append(zone.index[name], rr)
+
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone.SOA = soa
+			continue
+		}
+		if name == origin || seen[name] {
+			continue
+		}
+		seen[name] = true
+		zone.Subdomains = append(zone.Subdomains, strings.TrimSuffix(name, "."+origin))
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	if zone.SOA == nil {
+		return nil, fmt.Errorf("zone file has no SOA record")
+	}
+	sort.Strings(zone.Subdomains)
+
+	return zone, nil
+}
+
+// lookup はゾーンファイルに書かれた name (FQDN) のレコードを返します
+func (z *zoneFile) lookup(name string) []dns.RR {
+	return z.index[strings.ToLower(name)]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"slices"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// アイコン画像の検証と変換。
+// アップロードされた画像はJPEGにそろえて保存し、一覧表示などで使う縮小版を iconSizes の大きさで作る。
+const (
+	// iconMaxBytes はアップロードできる画像のバイト数の上限です
+	iconMaxBytes = 5 << 20
+	// iconMaxRequestBytes はbase64で送られてくるリクエストボディの上限です
+	iconMaxRequestBytes = (iconMaxBytes+2)/3*4 + 1<<10
+	// iconMaxPixels は展開後の画素数の上限で、小さなファイルで巨大な画像を展開させられないようにする
+	iconMaxPixels = 4096 * 4096
+
+	iconJPEGQuality = 90
+)
+
+// iconSizes は縮小版の一辺のピクセル数で、GET /api/user/:username/icon?size=64 のように指定できる
+var iconSizes = []int{64, 256}
+
+// iconFormats は受け付ける画像の形式です
+var iconFormats = []string{"jpeg", "png", "webp"}
+
+var errInvalidIcon = errors.New("invalid icon")
+
+// normalizeIcon はアップロードされた画像を検証してJPEGにそろえます。
+// JPEGはそのまま保存するので、icon_hash はアップロードした画像のSHA-256と一致する。
+func normalizeIcon(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: image is empty", errInvalidIcon)
+	}
+	if len(data) > iconMaxBytes {
+		return nil, fmt.Errorf("%w: image must be at most %d bytes", errInvalidIcon, iconMaxBytes)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !slices.Contains(iconFormats, format) {
+		return nil, fmt.Errorf("%w: image must be jpeg, png or webp", errInvalidIcon)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > iconMaxPixels {
+		return nil, fmt.Errorf("%w: image is too large: %dx%d", errInvalidIcon, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode %s: %v", errInvalidIcon, format, err)
+	}
+
+	if format == "jpeg" {
+		return data, nil
+	}
+	return encodeIcon(img, img.Bounds().Dx(), img.Bounds().Dy())
+}
+
+// iconVariants はJPEGの data から iconSizes の縮小版を作ります
+func iconVariants(data []byte) (map[int][]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidIcon, err)
+	}
+	variants := make(map[int][]byte, len(iconSizes))
+	for _, size := range iconSizes {
+		if variants[size], err = resizeIcon(img, size); err != nil {
+			return nil, err
+		}
+	}
+	return variants, nil
+}
+
+// resizeIcon は img を一辺 size に収まるよう縮小したJPEGを返します。拡大はしない。
+func resizeIcon(img image.Image, size int) ([]byte, error) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(h*size/w, 1)
+		} else {
+			w, h = max(w*size/h, 1), size
+		}
+	}
+	return encodeIcon(img, w, h)
+}
+
+// encodeIcon は img を w x h に拡縮してJPEGにします。透過部分は白で塗る。
+func encodeIcon(img image.Image, w int, h int) ([]byte, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	if w == img.Bounds().Dx() && h == img.Bounds().Dy() {
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	}
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, dst, &jpeg.Options{Quality: iconJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode icon: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// parseIconSize は size クエリパラメータを解釈します。空なら元の大きさを表す0を返す。
+func parseIconSize(v string) (int, bool) {
+	if v == "" {
+		return 0, true
+	}
+	for _, size := range iconSizes {
+		if v == fmt.Sprint(size) {
+			return size, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testWebP は1x1のロスレスWebPです
+const testWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+// newTestIcon は c で塗りつぶした300x200のJPEGを返します
+func newTestIcon(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+	return b.Bytes()
+}
+
+func decodeTestIcon(t *testing.T, b []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("icon must be jpeg: %v", err)
+	}
+	return img
+}
+
+// newTestPNGHeader は画素データを持たず、IHDRだけで width x height を名乗るPNGを返します
+func newTestPNGHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 6 // 8bit RGBA
+
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&b, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	b.Write(chunk)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return b.Bytes()
+}
+
+func TestNormalizeIcon(t *testing.T) {
+	// JPEGはハッシュが変わらないようそのまま保存する
+	jpg := newTestIcon(t, color.White)
+	got, err := normalizeIcon(jpg)
+	if err != nil || !bytes.Equal(got, jpg) {
+		t.Errorf("jpeg must be stored as is (err=%v)", err)
+	}
+
+	// PNGとWebPはJPEGに変換する
+	transparent := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	var b bytes.Buffer
+	if err := png.Encode(&b, transparent); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	got, err = normalizeIcon(b.Bytes())
+	if err != nil {
+		t.Fatalf("png: failed to normalize: %v", err)
+	}
+	img := decodeTestIcon(t, got)
+	if img.Bounds() != transparent.Bounds() {
+		t.Errorf("png: size must be kept: %v", img.Bounds())
+	}
+	// 透過部分は白にする
+	if r, g, bl, _ := img.At(0, 0).RGBA(); r < 0xf000 || g < 0xf000 || bl < 0xf000 {
+		t.Errorf("png: transparent pixels must be white")
+	}
+
+	webp, _ := base64.StdEncoding.DecodeString(testWebP)
+	got, err = normalizeIcon(webp)
+	if err != nil {
+		t.Fatalf("webp: failed to normalize: %v", err)
+	}
+	if img := decodeTestIcon(t, got); img.Bounds() != image.Rect(0, 0, 1, 1) {
+		t.Errorf("webp: size must be kept: %v", img.Bounds())
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"text":      []byte("not an image"),
+		"truncated": jpg[:len(jpg)/2],
+		"too large": newTestPNGHeader(4097, 4097),
+		"too big":   append(bytes.Clone(jpg), make([]byte, iconMaxBytes)...),
+	} {
+		if _, err := normalizeIcon(data); !errors.Is(err, errInvalidIcon) {
+			t.Errorf("%s: want errInvalidIcon, got %v", name, err)
+		}
+	}
+}
+
+func TestIconVariants(t *testing.T) {
+	variants, err := iconVariants(newTestIcon(t, color.White))
+	if err != nil {
+		t.Fatalf("failed to create variants: %v", err)
+	}
+	// 300x200は縦横比を保って縮小し、256pxより小さくはしても拡大はしない
+	want := map[int]image.Rectangle{
+		64:  image.Rect(0, 0, 64, 42),
+		256: image.Rect(0, 0, 256, 170),
+	}
+	for _, size := range iconSizes {
+		if got := decodeTestIcon(t, variants[size]).Bounds(); got != want[size] {
+			t.Errorf("%dpx: want %v, got %v", size, want[size], got)
+		}
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	b, err := resizeIcon(small, 64)
+	if err != nil {
+		t.Fatalf("failed to resize: %v", err)
+	}
+	if got := decodeTestIcon(t, b).Bounds(); got != small.Bounds() {
+		t.Errorf("small icons must not be enlarged: %v", got)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// アイコン画像の保存とノード間の複製。
+// 画像はSHA-256で引く icon_blobs に1度だけ保存し、icons.image_hash で参照する。参照数が0になった画像は削除する。
+// ファイルは ../icons/<hash>.jpg と縮小版の ../icons/<size>/<hash>.jpg で、内容が変わらないので古くなることはない。
+// アップロードを受けたノードが各ノードにpushし、取りこぼしたノードは読み出し時にDBから取り直す。
+// ピアと共有トークンはDNSの同期と同じ ISUCON13_DNS_SYNC_PEERS と ISUCON13_DNS_SYNC_TOKEN を使う。
+const (
+	iconsDir = "../icons"
+
+	iconsPushPath  = "/api/internal/icons/:hash"
+	iconsResetPath = "/api/internal/icons/reset"
+
+	// iconsSweepInterval ごとに、削除の通知を取りこぼして残った画像を消す
+	iconsSweepInterval = 10 * time.Minute
+)
+
+var icons = newIconStore(iconsDir, dnsSync.peers, dnsSync.token)
+
+var iconHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// iconStore はこのノードのアイコンのファイルを管理します
+type iconStore struct {
+	dir    string
+	peers  []string
+	token  string
+	client *http.Client
+
+	// load はローカルに無い画像を読み出します。nilならDBの icon_blobs を読む。
+	load func(ctx context.Context, hash string) ([]byte, error)
+	// referenced は参照されている画像のハッシュを返します。nilならDBの icon_blobs を読む。
+	referenced func(ctx context.Context) ([]string, error)
+}
+
+func newIconStore(dir string, peers []string, token string) *iconStore {
+	return &iconStore{
+		dir:    dir,
+		peers:  peers,
+		token:  token,
+		client: &http.Client{Timeout: dnsSyncPushTimeout},
+	}
+}
+
+// path は画像のファイルのパスです。size が0なら元の大きさ、それ以外は縮小版を表す。
+func (s *iconStore) path(hash string, size int) string {
+	if size == 0 {
+		return filepath.Join(s.dir, fmt.Sprintf("%s.jpg", hash))
+	}
+	return filepath.Join(s.dir, strconv.Itoa(size), fmt.Sprintf("%s.jpg", hash))
+}
+
+// Store は image と、その縮小版をこのノードに保存してハッシュを返します。image はJPEGであることを前提とする。
+// 同じ画像が既にあれば何もしない。
+func (s *iconStore) Store(image []byte) (string, error) {
+	hash := iconHashOf(image)
+	if _, err := os.Stat(s.path(hash, 0)); err == nil {
+		return hash, nil
+	}
+	return hash, s.write(hash, image)
+}
+
+func (s *iconStore) write(hash string, image []byte) error {
+	variants, err := iconVariants(image)
+	if err != nil {
+		return err
+	}
+	// 元の画像を最後に置き、元の画像があれば縮小版もあるようにする
+	for size, b := range variants {
+		if err := writeFileAtomic(s.path(hash, size), b); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(s.path(hash, 0), image)
+}
+
+// writeFileAtomic は読み出し中のリクエストに書きかけのファイルを見せないよう、一時ファイルをrenameして書き込みます
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".icon-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, bytes.NewReader(b)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
+
+// Get は hash の画像を size の大きさで返します。
+// このノードに無ければ load で読み出して保存する。読み出せなければ os.ErrNotExist を返す。
+func (s *iconStore) Get(ctx context.Context, hash string, size int) ([]byte, error) {
+	b, err := os.ReadFile(s.path(hash, size))
+	if !errors.Is(err, os.ErrNotExist) {
+		return b, err
+	}
+
+	image, err := os.ReadFile(s.path(hash, 0))
+	if errors.Is(err, os.ErrNotExist) {
+		if image, err = s.doLoad(ctx, hash); err != nil {
+			return nil, err
+		}
+		if iconHashOf(image) != hash {
+			return nil, os.ErrNotExist
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	// 元の画像はあるが縮小版だけ消えていた場合も、ここで作り直す
+	if err := s.write(hash, image); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return image, nil
+	}
+	return os.ReadFile(s.path(hash, size))
+}
+
+func (s *iconStore) doLoad(ctx context.Context, hash string) ([]byte, error) {
+	if s.load != nil {
+		return s.load(ctx, hash)
+	}
+	var image []byte
+	if err := dbConn.GetContext(ctx, &image, "SELECT image FROM icon_blobs WHERE hash = ?", hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("failed to select icon: %w", err)
+	}
+	return image, nil
+}
+
+// Delete はこのノードから hash の画像を削除します
+func (s *iconStore) Delete(hash string) error {
+	// 元の画像を先に消し、縮小版だけが残っても Get で作り直されるようにする
+	if err := os.Remove(s.path(hash, 0)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove icon: %w", err)
+	}
+	for _, size := range iconSizes {
+		if err := os.Remove(s.path(hash, size)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove icon: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sweep は参照されなくなった画像をこのノードから削除します
+func (s *iconStore) Sweep(ctx context.Context) error {
+	var hashes []string
+	var err error
+	if s.referenced != nil {
+		hashes, err = s.referenced(ctx)
+	} else {
+		err = dbConn.SelectContext(ctx, &hashes, "SELECT hash FROM icon_blobs")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to select referenced icons: %w", err)
+	}
+	referenced := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		referenced[hash] = true
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read icons directory: %w", err)
+	}
+	for _, entry := range entries {
+		hash, ok := strings.CutSuffix(entry.Name(), ".jpg")
+		if !ok || !iconHashPattern.MatchString(hash) || referenced[hash] {
+			continue
+		}
+		if err := s.Delete(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunSweeper は interval ごとに Sweep を実行します。
+// goroutineで動かすことが想定されています。
+func (s *iconStore) RunSweeper(interval time.Duration, logger echo.Logger) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := s.Sweep(context.Background()); err != nil {
+			logger.Warnf("failed to sweep icons: %v", err)
+		}
+	}
+}
+
+// Reset はこのノードのアイコンをすべて削除します
+func (s *iconStore) Reset() error {
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("failed to remove icons directory: %w", err)
+	}
+	if err := os.Mkdir(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create icons directory: %w", err)
+	}
+	return nil
+}
+
+// Publish は image をすべてのピアにpushします。
+// 失敗したピアは読み出し時にDBから取り直すので、エラーは返すがリトライはしない。
+func (s *iconStore) Publish(ctx context.Context, image []byte) error {
+	return s.broadcast(ctx, http.MethodPut, "/api/internal/icons/"+iconHashOf(image), image)
+}
+
+// Unpublish はすべてのピアに hash の画像の削除を要求します。
+// 失敗したピアでは Sweep で削除される。
+func (s *iconStore) Unpublish(ctx context.Context, hash string) error {
+	return s.broadcast(ctx, http.MethodDelete, "/api/internal/icons/"+hash, nil)
+}
+
+// ResetPeers はすべてのピアにアイコンの削除を要求します。
+// initializeはs1にしか来ないので、他のノードにはこれで伝える。
+func (s *iconStore) ResetPeers(ctx context.Context) error {
+	return s.broadcast(ctx, http.MethodPost, iconsResetPath, nil)
+}
+
+func (s *iconStore) broadcast(ctx context.Context, method string, path string, body []byte) error {
+	return callPeers(ctx, s.client, s.peers, s.token, method, path, "image/jpeg", body)
+}
+
+// ピアからpushされた画像を保存するAPI
+// PUT /api/internal/icons/:hash
+func (s *iconStore) pushHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, s.token); err != nil {
+		return err
+	}
+	defer c.Request().Body.Close()
+
+	image, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body")
+	}
+	if iconHashOf(image) != c.Param("hash") {
+		return echo.NewHTTPError(http.StatusBadRequest, "hash does not match the image")
+	}
+	if _, err := s.Store(image); err != nil {
+		if errors.Is(err, errInvalidIcon) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to store icon: "+err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ピアから参照されなくなった画像の削除を要求されるAPI
+// DELETE /api/internal/icons/:hash
+func (s *iconStore) deleteHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, s.token); err != nil {
+		return err
+	}
+	hash := c.Param("hash")
+	if !iconHashPattern.MatchString(hash) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid hash")
+	}
+	if err := s.Delete(hash); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete icon: "+err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ピアからアイコンの削除を要求されるAPI
+// POST /api/internal/icons/reset
+func (s *iconStore) resetHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, s.token); err != nil {
+		return err
+	}
+	if err := s.Reset(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset icons: "+err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// replaceUserIcon はユーザのアイコンを image に差し替えます。
+// 画像の参照数を数え直し、参照されなくなって icon_blobs から削除した画像のハッシュを返す。
+func replaceUserIcon(ctx context.Context, tx *sqlx.Tx, userID int64, image []byte) (int64, []string, error) {
+	var oldHashes []string
+	if err := tx.SelectContext(ctx, &oldHashes, "SELECT image_hash FROM icons WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		return 0, nil, fmt.Errorf("failed to select old user icon: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+		return 0, nil, fmt.Errorf("failed to delete old user icon: %w", err)
+	}
+
+	hash := iconHashOf(image)
+	if _, err := tx.ExecContext(ctx, "INSERT INTO icon_blobs (hash, image, ref_count) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE ref_count = ref_count + 1", hash, image); err != nil {
+		return 0, nil, fmt.Errorf("failed to insert icon blob: %w", err)
+	}
+	// 画像の本体は icon_blobs にだけ持つ
+	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image, image_hash) VALUES (?, ?, ?)", userID, []byte{}, hash)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert new user icon: %w", err)
+	}
+	iconID, err := rs.LastInsertId()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get last inserted icon id: %w", err)
+	}
+
+	var garbage []string
+	for _, oldHash := range oldHashes {
+		if _, err := tx.ExecContext(ctx, "UPDATE icon_blobs SET ref_count = ref_count - 1 WHERE hash = ?", oldHash); err != nil {
+			return 0, nil, fmt.Errorf("failed to release icon blob: %w", err)
+		}
+		rs, err := tx.ExecContext(ctx, "DELETE FROM icon_blobs WHERE hash = ? AND ref_count <= 0", oldHash)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to delete icon blob: %w", err)
+		}
+		if n, err := rs.RowsAffected(); err == nil && n > 0 {
+			garbage = append(garbage, oldHash)
+		}
+	}
+	return iconID, garbage, nil
+}
+
+func iconHashOf(image []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(image))
+}
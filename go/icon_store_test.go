@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// iconTestDB は icon_blobs の代わりです
+type iconTestDB struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (db *iconTestDB) set(image []byte) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash := iconHashOf(image)
+	db.blobs[hash] = image
+	return hash
+}
+
+func (db *iconTestDB) delete(hash string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.blobs, hash)
+}
+
+func (db *iconTestDB) load(_ context.Context, hash string) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	image, ok := db.blobs[hash]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return image, nil
+}
+
+func (db *iconTestDB) referenced(_ context.Context) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var hashes []string
+	for hash := range db.blobs {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+type iconTestNode struct {
+	store  *iconStore
+	server *httptest.Server
+}
+
+// newIconTestCluster はDBを共有する n 台のノードを起動し、互いをピアにします
+func newIconTestCluster(t *testing.T, n int) ([]*iconTestNode, *iconTestDB) {
+	t.Helper()
+
+	db := &iconTestDB{blobs: map[string][]byte{}}
+	nodes := make([]*iconTestNode, n)
+	for i := range nodes {
+		store := newIconStore(t.TempDir(), nil, "secret")
+		store.load = db.load
+		store.referenced = db.referenced
+
+		e := echo.New()
+		e.PUT(iconsPushPath, store.pushHandler)
+		e.DELETE(iconsPushPath, store.deleteHandler)
+		e.POST(iconsResetPath, store.resetHandler)
+		server := httptest.NewServer(e)
+		t.Cleanup(server.Close)
+
+		nodes[i] = &iconTestNode{store: store, server: server}
+	}
+	for i, node := range nodes {
+		for j, peer := range nodes {
+			if i != j {
+				node.store.peers = append(node.store.peers, peer.server.URL)
+			}
+		}
+	}
+	return nodes, db
+}
+
+// postIcon は postIconHandler と同じ順でアイコンを保存します
+func (node *iconTestNode) postIcon(t *testing.T, db *iconTestDB, image []byte) string {
+	t.Helper()
+	db.set(image)
+	hash, err := node.store.Store(image)
+	if err != nil {
+		t.Fatalf("failed to store icon: %v", err)
+	}
+	if err := node.store.Publish(context.Background(), image); err != nil {
+		t.Fatalf("failed to publish icon: %v", err)
+	}
+	return hash
+}
+
+func TestIconStore_Publish(t *testing.T) {
+	nodes, db := newIconTestCluster(t, 3)
+	image := newTestIcon(t, color.White)
+	hash := nodes[0].postIcon(t, db, image)
+
+	// DBを読まずに、pushされたファイルから返せる
+	db.delete(hash)
+	for i, node := range nodes {
+		got, err := node.store.Get(context.Background(), hash, 0)
+		if err != nil || !bytes.Equal(got, image) {
+			t.Errorf("s%d: want the uploaded icon, got %d bytes (err=%v)", i+1, len(got), err)
+		}
+		// 縮小版はpushを受けたノードでも作られている
+		for _, size := range iconSizes {
+			if _, err := os.Stat(node.store.path(hash, size)); err != nil {
+				t.Errorf("s%d: the %dpx icon is not stored: %v", i+1, size, err)
+			}
+		}
+	}
+}
+
+func TestIconStore_Deduplicate(t *testing.T) {
+	nodes, db := newIconTestCluster(t, 1)
+	image := newTestIcon(t, color.White)
+
+	// alice と bob が同じ画像をアップロードしても1つだけ保存する
+	alice := nodes[0].postIcon(t, db, image)
+	bob := nodes[0].postIcon(t, db, bytes.Clone(image))
+	if alice != bob {
+		t.Fatalf("identical images must have the same hash")
+	}
+	files, _ := filepath.Glob(filepath.Join(nodes[0].store.dir, "*.jpg"))
+	if len(files) != 1 {
+		t.Errorf("want 1 file, got %v", files)
+	}
+}
+
+func TestIconStore_LoadOnMiss(t *testing.T) {
+	nodes, db := newIconTestCluster(t, 2)
+	// s2は落ちていてpushを受け取れなかったものとする
+	nodes[0].store.peers = nil
+
+	image := newTestIcon(t, color.Black)
+	hash := nodes[0].postIcon(t, db, image)
+
+	got, err := nodes[1].store.Get(context.Background(), hash, 64)
+	if err != nil {
+		t.Fatalf("failed to get 64px icon: %v", err)
+	}
+	if r, _, _, _ := decodeTestIcon(t, got).At(0, 0).RGBA(); r > 0x1000 {
+		t.Errorf("the 64px icon is not created from the uploaded icon")
+	}
+	// DBから取り直したものは保存しておく
+	b, err := os.ReadFile(nodes[1].store.path(hash, 0))
+	if err != nil || !bytes.Equal(b, image) {
+		t.Errorf("the icon is not stored on s2: %d bytes (err=%v)", len(b), err)
+	}
+
+	// 縮小版だけ消えていても作り直す
+	if err := os.Remove(nodes[1].store.path(hash, 256)); err != nil {
+		t.Fatalf("failed to remove 256px icon: %v", err)
+	}
+	db.delete(hash)
+	if _, err := nodes[1].store.Get(context.Background(), hash, 256); err != nil {
+		t.Errorf("failed to recreate 256px icon: %v", err)
+	}
+
+	// DBにも無ければ NoImage にさせる
+	if _, err := nodes[1].store.Get(context.Background(), iconHashOf([]byte("nobody")), 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestIconStore_GarbageCollect(t *testing.T) {
+	nodes, db := newIconTestCluster(t, 3)
+	old := nodes[0].postIcon(t, db, newTestIcon(t, color.White))
+	// s3は落ちていて削除の通知を受け取れなかったものとする
+	nodes[0].store.peers = nodes[0].store.peers[:1]
+
+	// 最後の参照が無くなった画像は全ノードから消す
+	db.delete(old)
+	if err := nodes[0].store.Delete(old); err != nil {
+		t.Fatalf("failed to delete icon: %v", err)
+	}
+	if err := nodes[0].store.Unpublish(context.Background(), old); err != nil {
+		t.Fatalf("failed to unpublish icon: %v", err)
+	}
+	for i, node := range nodes[:2] {
+		for _, size := range append([]int{0}, iconSizes...) {
+			if _, err := os.Stat(node.store.path(old, size)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("s%d: the %dpx icon must be removed: %v", i+1, size, err)
+			}
+		}
+	}
+
+	// 取りこぼしたノードでは Sweep で消え、参照されている画像は残る
+	nodes[2].store.peers = nil
+	current, err := nodes[2].store.Store(newTestIcon(t, color.Black))
+	if err != nil {
+		t.Fatalf("failed to store icon: %v", err)
+	}
+	db.set(newTestIcon(t, color.Black))
+	if err := nodes[2].store.Sweep(context.Background()); err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	if _, err := os.Stat(nodes[2].store.path(old, 0)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s3: the unreferenced icon must be swept: %v", err)
+	}
+	if _, err := os.Stat(nodes[2].store.path(current, 0)); err != nil {
+		t.Errorf("s3: the referenced icon must be kept: %v", err)
+	}
+}
+
+func TestIconStore_ResetPeers(t *testing.T) {
+	nodes, db := newIconTestCluster(t, 3)
+	hash := nodes[0].postIcon(t, db, newTestIcon(t, color.White))
+
+	// initializeでTRUNCATEされたものとする
+	db.delete(hash)
+	if err := nodes[0].store.Reset(); err != nil {
+		t.Fatalf("failed to reset icons: %v", err)
+	}
+	if err := nodes[0].store.ResetPeers(context.Background()); err != nil {
+		t.Fatalf("failed to reset icons on peers: %v", err)
+	}
+
+	for i, node := range nodes {
+		if _, err := node.store.Get(context.Background(), hash, 0); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("s%d: want os.ErrNotExist, got %v", i+1, err)
+		}
+	}
+}
+
+func TestIconStore_RejectsInvalidPush(t *testing.T) {
+	nodes, _ := newIconTestCluster(t, 2)
+	nodes[1].store.token = "another"
+
+	image := newTestIcon(t, color.White)
+	if err := nodes[0].store.Publish(context.Background(), image); err == nil {
+		t.Errorf("publish must fail with an invalid token")
+	}
+
+	nodes[1].store.token = "secret"
+	if err := nodes[0].store.broadcast(context.Background(), "PUT", "/api/internal/icons/"+iconHashOf([]byte("another")), image); err == nil {
+		t.Errorf("publish must fail with a hash that does not match")
+	}
+	if err := nodes[0].store.Publish(context.Background(), []byte("not an image")); err == nil {
+		t.Errorf("publish must fail with an invalid image")
+	}
+}
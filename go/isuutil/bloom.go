@@ -0,0 +1,73 @@
+package isuutil
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+
+	"github.com/cespare/xxhash"
+)
+
+// BloomFilter は集合に含まれない要素を高速に弾くためのフィルタです。
+// MayContain が false なら確実に含まれませんが、true の場合は誤検出があり得るので、正確な集合で確認してください。
+// 複数のgoroutineから参照しながら要素を追加したい場合は、Clone したものに Add してから差し替えてください。
+type BloomFilter struct {
+	bits []uint64
+	// mask はビット数-1で、ビット数は剰余を避けるため2の冪にしている
+	mask uint64
+	k    int
+}
+
+// NewBloomFilter は items を含み、誤検出率がおおよそ falsePositiveRate になるフィルタを作成します。
+func NewBloomFilter(items []string, falsePositiveRate float64) *BloomFilter {
+	n := float64(max(len(items), 1))
+	m := uint64(math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	m = max(uint64(1)<<bits.Len64(m-1), 64)
+	k := max(int(math.Round(float64(m)/n*math.Ln2)), 1)
+
+	f := &BloomFilter{bits: make([]uint64, m/64), mask: m - 1, k: k}
+	for _, item := range items {
+		f.Add(item)
+	}
+	return f
+}
+
+// Add は item をフィルタに追加します。作成時より多く追加すると誤検出率が上がります。
+func (f *BloomFilter) Add(item string) {
+	f.AddHash(xxhash.Sum64String(item))
+}
+
+// AddHash は xxhash.Sum64String で計算済みのハッシュ値で要素を追加します
+func (f *BloomFilter) AddHash(h uint64) {
+	h1, h2 := bloomHash(h)
+	for i := 0; i < f.k; i++ {
+		j := (h1 + uint64(i)*h2) & f.mask
+		f.bits[j/64] |= 1 << (j % 64)
+	}
+}
+
+func (f *BloomFilter) MayContain(item string) bool {
+	return f.MayContainHash(xxhash.Sum64String(item))
+}
+
+// MayContainHash は xxhash.Sum64String で計算済みのハッシュ値で要素を確認します。
+// 呼び出し側でも同じハッシュ値を使う場合に、計算を1回で済ませられます。
+func (f *BloomFilter) MayContainHash(h uint64) bool {
+	h1, h2 := bloomHash(h)
+	for i := 0; i < f.k; i++ {
+		j := (h1 + uint64(i)*h2) & f.mask
+		if f.bits[j/64]&(1<<(j%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) Clone() *BloomFilter {
+	return &BloomFilter{bits: slices.Clone(f.bits), mask: f.mask, k: f.k}
+}
+
+// bloomHash は1つのハッシュ値から k 個の位置を作るための2つの値を返します (Kirsch-Mitzenmacher)
+func bloomHash(h uint64) (uint64, uint64) {
+	return h, bits.RotateLeft64(h, 32) | 1
+}
@@ -0,0 +1,30 @@
+package isuutil
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	var items []string
+	for i := 0; i < 10000; i++ {
+		items = append(items, fmt.Sprintf("user%d", i))
+	}
+	f := NewBloomFilter(items, 0.01)
+
+	for _, item := range items {
+		if !f.MayContain(item) {
+			t.Fatalf("false negative: %s", item)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain(fmt.Sprintf("nobody%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Errorf("too many false positives: %d/10000", falsePositives)
+	}
+}
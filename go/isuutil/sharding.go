@@ -58,14 +58,32 @@ func NewShards[T Int](configs []*ShardConfig) (*Shards[T], error) {
 // GetShard は shardKey に応じたDBクライアントを返します。
 // シャードの選択は余剰方式によって行われます。
 func (s *Shards[T]) GetShard(shardKey T) *sqlx.DB {
-	key := int64(shardKey)   // 任意の数字
-	mod := key % s.weightSum // [0, weightSum) の間に収まるようにする
+	return s.shards[s.GetShardIndex(shardKey)].db
+}
+
+// GetShardIndex は shardKey が割り当てられるシャードのインデックスを返します。
+func (s *Shards[T]) GetShardIndex(shardKey T) int {
+	return pickShard(len(s.shards), func(i int) Weight { return s.shards[i].weight }, s.weightSum, int64(shardKey))
+}
+
+// ShardIndex は configs から NewShards したときに GetShard が選ぶシャードのインデックスを返します。
+// DBに接続せずに同じ割当を求められるので、DNSでの振り分けなどDB以外でシャードの配置を揃えたい場合に使えます。
+func ShardIndex[T Int](configs []*ShardConfig, shardKey T) int {
+	var weightSum int64
+	for _, config := range configs {
+		weightSum += int64(config.Weight)
+	}
+	return pickShard(len(configs), func(i int) Weight { return configs[i].Weight }, weightSum, int64(shardKey))
+}
+
+func pickShard(n int, weight func(i int) Weight, weightSum int64, key int64) int {
+	mod := key % weightSum // [0, weightSum) の間に収まるようにする
 
 	var boundary int64
-	for _, s := range s.shards {
-		boundary += int64(s.weight)
+	for i := 0; i < n; i++ {
+		boundary += int64(weight(i))
 		if mod < boundary {
-			return s.db
+			return i
 		}
 	}
 
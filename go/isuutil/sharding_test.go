@@ -1,8 +1,37 @@
 package isuutil
 
-import "testing"
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
 
 func TestIntToShardKey(t *testing.T) {
 	var i int64 = 1
 	t.Log(IntToShardKey(i))
 }
+
+func TestShardIndex(t *testing.T) {
+	configs := []*ShardConfig{
+		{DisplayName: "s1", Weight: 0},
+		{DisplayName: "s2", Weight: 1},
+		{DisplayName: "s3", Weight: 4},
+	}
+	// 接続せずに作るため、シャードごとに別のDBクライアントを入れておく
+	s := &Shards[int64]{}
+	for _, config := range configs {
+		s.shards = append(s.shards, &shard{weight: config.Weight, db: sqlx.NewDb(&sql.DB{}, "mysql")})
+		s.weightSum += int64(config.Weight)
+	}
+
+	for key := int64(0); key < 1000; key++ {
+		i := ShardIndex(configs, key)
+		if configs[i].Weight == 0 {
+			t.Fatalf("key %d is assigned to a shard with zero weight", key)
+		}
+		if s.GetShard(key) != s.GetShardFromIndex(i) {
+			t.Errorf("key %d: ShardIndex=%d disagrees with GetShard", key, i)
+		}
+	}
+}
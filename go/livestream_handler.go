@@ -291,7 +291,10 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return err
 	}
 
-	username := c.Param("username")
+	username, err := usernameParam(c)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ログインの試行回数の制限。
+// ユーザ名ごと、IPアドレスごとに失敗した回数を数え、一定の回数を超えると次に試せるまで指数的に待たせる。
+// さらに失敗すると一定時間ロックし、login_lockouts に記録して運営者が確認できるようにする。
+// 待たせている間はbcryptを実行せずに 429 を返すので、総当たりでCPUを使い切られることもない。
+// 失敗回数はDBに持つので、どのノードにリクエストが来ても同じように制限される。
+const (
+	loginScopeUser = "user"
+	loginScopeIP   = "ip"
+
+	// loginFailureWindow だけ失敗しなければ、失敗回数を数え直す
+	loginFailureWindow = 1 * time.Hour
+	loginBackoffBase   = 1 * time.Second
+	loginBackoffMax    = 5 * time.Minute
+	loginLockoutPeriod = 15 * time.Minute
+
+	// loginPendingWait は実行中の試行が多いときに、結果が分かるのを待つ上限です
+	loginPendingWait = 3 * time.Second
+	loginPendingPoll = 20 * time.Millisecond
+	// loginPendingExpiry より前に予約したまま残っている試行は、ノードが落ちたものとして数えない
+	loginPendingExpiry = 1 * time.Minute
+)
+
+type loginThrottlePolicy struct {
+	// Free はこの回数の失敗までは待たせない
+	Free int64
+	// Lockout はこの回数失敗するとロックする
+	Lockout int64
+}
+
+// loginThrottlePolicies は scope ごとの制限で、IPアドレスはNATで共有されることがあるので緩くする
+var loginThrottlePolicies = map[string]loginThrottlePolicy{
+	loginScopeUser: {Free: 3, Lockout: 10},
+	loginScopeIP:   {Free: 20, Lockout: 100},
+}
+
+type loginThrottleKey struct {
+	Scope string
+	Name  string
+}
+
+// loginThrottleKeys はログインリクエストを数える単位です
+func loginThrottleKeys(c echo.Context, username string) []loginThrottleKey {
+	return []loginThrottleKey{
+		{Scope: loginScopeUser, Name: truncate(username, 255)},
+		{Scope: loginScopeIP, Name: truncate(c.RealIP(), 255)},
+	}
+}
+
+// loginRetryAt は failures 回失敗したあとに次に試せる時刻と、ロックしたかどうかを返します
+func loginRetryAt(policy loginThrottlePolicy, failures int64, now time.Time) (time.Time, bool) {
+	if failures >= policy.Lockout {
+		return now.Add(loginLockoutPeriod), failures == policy.Lockout
+	}
+	if failures <= policy.Free {
+		return now, false
+	}
+	// 1s, 2s, 4s, ... と倍にしていき、loginBackoffMax で打ち止めにする
+	backoff := loginBackoffMax
+	if n := failures - policy.Free - 1; n < 32 {
+		backoff = min(loginBackoffBase<<n, loginBackoffMax)
+	}
+	return now.Add(backoff), false
+}
+
+// loginAttempt は reserveLoginAttempt で予約した試行です。
+// 予約している間は pending として数え、結果が分かってから Fail で失敗回数を増やすか、Release で取り消す。
+// 実行中の試行がすべて失敗しても待たせる回数を超えない分しか同時に始めさせないので、大量に送られても待ち時間を飛び越えられない。
+type loginAttempt struct {
+	keys []loginThrottleKey
+	// settled は Fail か Release が済んだかどうかです
+	settled bool
+}
+
+// loginFailureRow は login_failures の1行です
+type loginFailureRow struct {
+	Failures     int64 `db:"failures"`
+	LastFailedAt int64 `db:"last_failed_at"`
+	RetryAt      int64 `db:"retry_at"`
+	// Pending は結果が分かっていない試行の数、PendingAt は最後に予約した時刻
+	Pending   int64 `db:"pending"`
+	PendingAt int64 `db:"pending_at"`
+}
+
+// loginThrottleStore は試行回数を保存する先です。テストではDBの代わりを渡す。
+type loginThrottleStore interface {
+	// Update は keys の行を無ければ作ってロックし、fn に渡します。fn が true を返せば書き換えた行を保存する。
+	Update(ctx context.Context, keys []loginThrottleKey, fn func(rows []loginFailureRow) bool) error
+	// InsertLockout はロックしたことを記録します
+	InsertLockout(ctx context.Context, key loginThrottleKey, failures int64, lockedUntil int64, now time.Time) error
+}
+
+var loginThrottle loginThrottleStore = dbLoginThrottleStore{}
+
+// dbLoginThrottleStore は login_failures と login_lockouts に保存します。
+// 行は keys の順にロックするので、呼び出し元はいつも loginThrottleKeys の順で渡すこと。
+type dbLoginThrottleStore struct{}
+
+func (dbLoginThrottleStore) Update(ctx context.Context, keys []loginThrottleKey, fn func(rows []loginFailureRow) bool) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows := make([]loginFailureRow, len(keys))
+	for i, key := range keys {
+		// 行が無いと FOR UPDATE でロックできないので、先に作っておく
+		if _, err := tx.ExecContext(ctx, "INSERT INTO login_failures (scope, name, failures, last_failed_at, retry_at) VALUES (?, ?, 0, 0, 0) "+
+			"ON DUPLICATE KEY UPDATE failures = failures", key.Scope, key.Name); err != nil {
+			return fmt.Errorf("failed to insert login failures: %w", err)
+		}
+		if err := tx.GetContext(ctx, &rows[i], "SELECT failures, last_failed_at, retry_at, pending, pending_at FROM login_failures WHERE scope = ? AND name = ? FOR UPDATE", key.Scope, key.Name); err != nil {
+			return fmt.Errorf("failed to get login failures: %w", err)
+		}
+	}
+	if !fn(rows) {
+		return nil
+	}
+	for i, key := range keys {
+		row := rows[i]
+		if _, err := tx.ExecContext(ctx, "UPDATE login_failures SET failures = ?, last_failed_at = ?, retry_at = ?, pending = ?, pending_at = ? WHERE scope = ? AND name = ?",
+			row.Failures, row.LastFailedAt, row.RetryAt, row.Pending, row.PendingAt, key.Scope, key.Name); err != nil {
+			return fmt.Errorf("failed to update login failures: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (dbLoginThrottleStore) InsertLockout(ctx context.Context, key loginThrottleKey, failures int64, lockedUntil int64, now time.Time) error {
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO login_lockouts (scope, name, failures, locked_until, created_at) VALUES (?, ?, ?, ?, ?)",
+		key.Scope, key.Name, failures, lockedUntil, now.Unix()); err != nil {
+		return fmt.Errorf("failed to insert login lockout: %w", err)
+	}
+	return nil
+}
+
+// loginFailuresAfter は last_failed_at から loginFailureWindow 経っていれば数え直して、1回増やした失敗回数を返します
+func loginFailuresAfter(failures int64, lastFailedAt int64, now time.Time) int64 {
+	if lastFailedAt < now.Add(-loginFailureWindow).Unix() {
+		failures = 0
+	}
+	return failures + 1
+}
+
+// reserveLoginAttempt は待たせているキーがあれば、次に試せるまでの時間を返します。
+// 実行中の試行が多くて始められなければ、それらの結果が分かるまで loginPendingWait を上限に待つ。
+func reserveLoginAttempt(ctx context.Context, keys []loginThrottleKey) (*loginAttempt, time.Duration, error) {
+	deadline := time.Now().Add(loginPendingWait)
+	for {
+		wait, busy, err := tryReserveLoginAttempt(ctx, keys, time.Now())
+		if err != nil {
+			return nil, 0, err
+		}
+		if wait > 0 {
+			return nil, wait, nil
+		}
+		if !busy {
+			return &loginAttempt{keys: keys}, 0, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, loginBackoffBase, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(loginPendingPoll):
+		}
+	}
+}
+
+// tryReserveLoginAttempt は試行を始められれば pending を増やします。
+// 待たせているキーがあれば待ち時間を、実行中の試行が多くて始められなければ busy を返す。
+func tryReserveLoginAttempt(ctx context.Context, keys []loginThrottleKey, now time.Time) (time.Duration, bool, error) {
+	var wait time.Duration
+	busy := false
+	err := loginThrottle.Update(ctx, keys, func(rows []loginFailureRow) bool {
+		for i := range rows {
+			wait = max(wait, time.Unix(rows[i].RetryAt, 0).Sub(now))
+		}
+		if wait > 0 {
+			return false
+		}
+		for i, key := range keys {
+			row := &rows[i]
+			// 落ちたノードが予約したまま残した分は数えない
+			if row.PendingAt < now.Add(-loginPendingExpiry).Unix() {
+				row.Pending = 0
+			}
+			failures := row.Failures
+			if row.LastFailedAt < now.Add(-loginFailureWindow).Unix() {
+				failures = 0
+			}
+			// 1つずつなら待ち時間の後に試せる。並行して試せるのは、すべて失敗しても待たせる回数を超えない分だけ
+			if row.Pending > 0 && failures+row.Pending > loginThrottlePolicies[key.Scope].Free {
+				busy = true
+				return false
+			}
+		}
+		for i := range rows {
+			rows[i].Pending++
+			rows[i].PendingAt = now.Unix()
+		}
+		return true
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return wait, busy, nil
+}
+
+// Fail は予約した試行を失敗として数えます。ロックしたら login_lockouts に記録する。
+func (a *loginAttempt) Fail(ctx context.Context) error {
+	if a.settled {
+		return nil
+	}
+	a.settled = true
+
+	now := time.Now()
+	failures := make([]int64, len(a.keys))
+	retryAt := make([]int64, len(a.keys))
+	locked := make([]bool, len(a.keys))
+	if err := loginThrottle.Update(ctx, a.keys, func(rows []loginFailureRow) bool {
+		for i, key := range a.keys {
+			row := &rows[i]
+			failures[i] = loginFailuresAfter(row.Failures, row.LastFailedAt, now)
+			t, l := loginRetryAt(loginThrottlePolicies[key.Scope], failures[i], now)
+			retryAt[i], locked[i] = t.Unix(), l
+			row.Failures, row.LastFailedAt, row.RetryAt = failures[i], now.Unix(), retryAt[i]
+			row.Pending = max(row.Pending-1, 0)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	for i, key := range a.keys {
+		if !locked[i] {
+			continue
+		}
+		if err := loginThrottle.InsertLockout(ctx, key, failures[i], retryAt[i], now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release は予約した試行を取り消します。パスワードが合ったときや、サーバー側のエラーで確かめられなかったときに使う。
+// 失敗回数や次に試せる時刻には触れない。
+func (a *loginAttempt) Release(ctx context.Context) error {
+	if a.settled {
+		return nil
+	}
+	a.settled = true
+	if err := loginThrottle.Update(ctx, a.keys, func(rows []loginFailureRow) bool {
+		for i := range rows {
+			rows[i].Pending = max(rows[i].Pending-1, 0)
+		}
+		return true
+	}); err != nil {
+		return fmt.Errorf("failed to release login attempt: %w", err)
+	}
+	return nil
+}
+
+// releaseLoginAttempt は Fail も Release もしていない試行を取り消します。予約したらdeferで呼ぶこと。
+func releaseLoginAttempt(c echo.Context, a *loginAttempt) {
+	if err := a.Release(c.Request().Context()); err != nil {
+		c.Logger().Warnf("failed to release login attempt: %v", err)
+	}
+}
+
+// resetLoginFailures はログインに成功したときに失敗回数を消します。実行中の他の試行の pending は残す。
+// IPアドレスの失敗回数は、自分のアカウントにログインして消されると多数のユーザ名を試せてしまうので消さない。
+func resetLoginFailures(ctx context.Context, keys []loginThrottleKey) error {
+	var userKeys []loginThrottleKey
+	for _, key := range keys {
+		if key.Scope == loginScopeUser {
+			userKeys = append(userKeys, key)
+		}
+	}
+	if len(userKeys) == 0 {
+		return nil
+	}
+	return loginThrottle.Update(ctx, userKeys, func(rows []loginFailureRow) bool {
+		for i := range rows {
+			rows[i].Failures, rows[i].LastFailedAt, rows[i].RetryAt = 0, 0, 0
+		}
+		return true
+	})
+}
+
+// tooManyLoginAttempts は Retry-After を付けて 429 を返します
+func tooManyLoginAttempts(c echo.Context, wait time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many login attempts")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoginRetryAt(t *testing.T) {
+	policy := loginThrottlePolicy{Free: 3, Lockout: 10}
+	now := time.Unix(1700000000, 0)
+
+	for _, tt := range []struct {
+		failures int64
+		wait     time.Duration
+		locked   bool
+	}{
+		{failures: 1, wait: 0},
+		{failures: 3, wait: 0},
+		{failures: 4, wait: 1 * time.Second},
+		{failures: 5, wait: 2 * time.Second},
+		{failures: 9, wait: 32 * time.Second},
+		// ロックを記録するのは閾値に達したときの1回だけ
+		{failures: 10, wait: loginLockoutPeriod, locked: true},
+		{failures: 11, wait: loginLockoutPeriod},
+	} {
+		retryAt, locked := loginRetryAt(policy, tt.failures, now)
+		if got := retryAt.Sub(now); got != tt.wait || locked != tt.locked {
+			t.Errorf("failures=%d: want (%v, %v), got (%v, %v)", tt.failures, tt.wait, tt.locked, got, locked)
+		}
+	}
+
+	// 待ち時間は loginBackoffMax で打ち止めにする
+	retryAt, _ := loginRetryAt(loginThrottlePolicy{Free: 0, Lockout: 1000}, 999, now)
+	if got := retryAt.Sub(now); got != loginBackoffMax {
+		t.Errorf("want %v, got %v", loginBackoffMax, got)
+	}
+}
+
+func TestTooManyLoginAttempts(t *testing.T) {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/login", nil), rec)
+
+	err := tooManyLoginAttempts(c, 1500*time.Millisecond)
+	if he, ok := err.(*echo.HTTPError); !ok || he.Code != http.StatusTooManyRequests {
+		t.Errorf("want 429, got %v", err)
+	}
+	// 秒未満は切り上げる
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("want Retry-After: 2, got %q", got)
+	}
+}
+
+func TestLoginFailuresAfter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	if got := loginFailuresAfter(3, now.Add(-time.Minute).Unix(), now); got != 4 {
+		t.Errorf("want 4, got %d", got)
+	}
+	// loginFailureWindow より前の失敗は数え直す
+	if got := loginFailuresAfter(3, now.Add(-loginFailureWindow-time.Second).Unix(), now); got != 1 {
+		t.Errorf("want 1, got %d", got)
+	}
+}
+
+// memoryLoginThrottleStore は loginThrottleStore をメモリに持ちます
+type memoryLoginThrottleStore struct {
+	mu       sync.Mutex
+	rows     map[loginThrottleKey]loginFailureRow
+	lockouts []loginThrottleKey
+}
+
+func (s *memoryLoginThrottleStore) Update(_ context.Context, keys []loginThrottleKey, fn func(rows []loginFailureRow) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := make([]loginFailureRow, len(keys))
+	for i, key := range keys {
+		rows[i] = s.rows[key]
+	}
+	if fn(rows) {
+		for i, key := range keys {
+			s.rows[key] = rows[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryLoginThrottleStore) InsertLockout(_ context.Context, key loginThrottleKey, _ int64, _ int64, _ time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockouts = append(s.lockouts, key)
+	return nil
+}
+
+func (s *memoryLoginThrottleStore) row(key loginThrottleKey) loginFailureRow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rows[key]
+}
+
+func setupTestLoginThrottle(t *testing.T) *memoryLoginThrottleStore {
+	t.Helper()
+	store := &memoryLoginThrottleStore{rows: map[loginThrottleKey]loginFailureRow{}}
+	prev := loginThrottle
+	t.Cleanup(func() { loginThrottle = prev })
+	loginThrottle = store
+	return store
+}
+
+func TestReserveLoginAttempt_ParallelSuccess(t *testing.T) {
+	store := setupTestLoginThrottle(t)
+	ip := loginThrottleKey{Scope: loginScopeIP, Name: "192.0.2.1"}
+
+	// 同じIPアドレスから、許される失敗回数より多くのユーザが同時にログインに成功する
+	const n = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		keys := []loginThrottleKey{{Scope: loginScopeUser, Name: fmt.Sprintf("user%d", i)}, ip}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, wait, err := reserveLoginAttempt(context.Background(), keys)
+			if err != nil || wait > 0 {
+				errs <- fmt.Errorf("want to be reserved, got (%v, %v)", wait, err)
+				return
+			}
+			// bcryptの代わり
+			time.Sleep(5 * time.Millisecond)
+			if err := attempt.Release(context.Background()); err != nil {
+				errs <- err
+				return
+			}
+			if err := resetLoginFailures(context.Background(), keys); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if row := store.row(ip); row.Failures != 0 || row.LastFailedAt != 0 || row.RetryAt != 0 || row.Pending != 0 {
+		t.Errorf("successful logins must not be counted as failures: %+v", row)
+	}
+}
+
+func TestReserveLoginAttempt_ParallelFailures(t *testing.T) {
+	store := setupTestLoginThrottle(t)
+	keys := []loginThrottleKey{{Scope: loginScopeUser, Name: "alice"}, {Scope: loginScopeIP, Name: "192.0.2.1"}}
+	free := loginThrottlePolicies[loginScopeUser].Free
+
+	// すべて失敗しても待たせる回数を超えない分までは同時に試せる
+	var attempts []*loginAttempt
+	for i := int64(0); i <= free; i++ {
+		attempt, wait, err := reserveLoginAttempt(context.Background(), keys)
+		if err != nil || wait > 0 {
+			t.Fatalf("attempt %d: want to be reserved, got (%v, %v)", i, wait, err)
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	// それ以上は、実行中の試行の結果が分かるまで始められない
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := reserveLoginAttempt(ctx, keys); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want to wait for pending attempts, got %v", err)
+	}
+
+	for _, attempt := range attempts {
+		if err := attempt.Fail(context.Background()); err != nil {
+			t.Fatalf("failed to fail attempt: %v", err)
+		}
+	}
+	if _, wait, err := reserveLoginAttempt(context.Background(), keys); err != nil || wait <= 0 {
+		t.Errorf("want to wait after %d failures, got (%v, %v)", free+1, wait, err)
+	}
+	if row := store.row(keys[0]); row.Failures != free+1 || row.Pending != 0 {
+		t.Errorf("unexpected row: %+v", row)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	echolog "github.com/labstack/gommon/log"
 )
@@ -35,14 +34,11 @@ const (
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
-	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	dbConfig                 *mysql.Config
 )
 
 func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
-		secret = []byte(secretKey)
-	}
 }
 
 type InitializeResponse struct {
@@ -98,6 +94,7 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		conf.ParseTime = parseTime
 	}
 
+	dbConfig = conf
 	db, err := isuutil.NewIsuconDB(conf)
 	if err != nil {
 		return nil, err
@@ -182,15 +179,16 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	// sessionsはTRUNCATEしたので、キャッシュも捨てる
+	userSessions.Flush()
+
 	// iconsディレクトリの中身をすべて削除する
-	if err := os.RemoveAll("../icons"); err != nil {
-		c.Logger().Warnf("failed to remove icons directory with err=%s", err)
+	if err := icons.Reset(); err != nil {
+		c.Logger().Warnf("failed to reset icons with err=%s", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
-	// iconsディレクトリを作成する
-	if err := os.Mkdir("../icons", 0755); err != nil {
-		c.Logger().Warnf("failed to create icons directory with err=%s", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	if err := icons.ResetPeers(c.Request().Context()); err != nil {
+		c.Logger().Warnf("failed to reset icons on peers with err=%s", err)
 	}
 
 	//if err := isuutil.KickPproteinCollect(); err != nil {
@@ -202,6 +200,9 @@ func initializeHandler(c echo.Context) error {
 		c.Logger().Warnf("initializeDnsCache failed with err=%s", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
+	if err := dnsSync.Reload(c.Request().Context()); err != nil {
+		c.Logger().Warnf("failed to reload dns cache on peers with err=%s", err)
+	}
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -218,12 +219,27 @@ func main() {
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.OFF)
+	// nginxが付けるX-Real-IPだけを信じ、クライアントが付けたX-Forwarded-Forではログインの制限を逃れられないようにする
+	e.IPExtractor = echo.ExtractIPFromRealIPHeader()
 	//e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 	//	Format: "time=${time_rfc3339_nano} method=${method}, uri=${uri}, status=${status}, latency=${latency_human}, error=${error}\n",
 	//}))
-	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.dev"
+	if err := loadDNSConfig(); err != nil {
+		e.Logger.Errorf("failed to load dns config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadPasswordHashConfig(); err != nil {
+		e.Logger.Errorf("failed to load password hash config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadSessionSecrets(); err != nil {
+		e.Logger.Errorf("failed to load session secrets: %v", err)
+		os.Exit(1)
+	}
+	cookieStore := newCookieStore()
+	cookieStore.Options.Domain = "*." + domain
 	e.Use(session.Middleware(cookieStore))
+	e.Use(resignSessionCookie(cookieStore))
 	e.Use(middleware.Recover())
 	e.Use(otelecho.Middleware("webapp"))
 
@@ -267,12 +283,38 @@ func main() {
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
+	e.POST("/api/login/totp", postLoginTOTPHandler)
+	e.POST("/api/logout", logoutHandler)
+	e.POST("/api/password-reset", postPasswordResetHandler)
+	e.POST("/api/password-reset/confirm", postPasswordResetConfirmHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.PATCH("/api/user/me", patchMeHandler)
+	e.PUT("/api/user/me/password", putPasswordHandler)
+	e.GET("/api/user/me/sessions", getMySessionsHandler)
+	e.POST("/api/user/me/totp", postTOTPHandler)
+	e.POST("/api/user/me/totp/verify", postTOTPVerifyHandler)
+	e.DELETE("/api/user/me/totp", deleteTOTPHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/icon/:hash", getIconByHashHandler)
+
+	// internal
+	e.POST(dnsSyncNamesPath, dnsSync.namesHandler)
+	e.POST(dnsSyncReloadPath, dnsSync.reloadHandler)
+	e.GET(dnsRRLStatsPath, dnsRRLStatsHandler)
+	e.GET(dnsQueryLogPath, getDNSQueryLogHandler)
+	e.PUT(dnsQueryLogPath, putDNSQueryLogHandler)
+	e.GET(dnsShardsPath, dnsSync.getShardsHandler)
+	e.PUT(dnsShardsPath, dnsSync.putShardsHandler)
+	e.POST(dnsSyncShardsPath, dnsSync.shardsHandler)
+	e.GET(dnsMetricsPath, dnsMetricsHandler)
+	e.PUT(iconsPushPath, icons.pushHandler)
+	e.DELETE(iconsPushPath, icons.deleteHandler)
+	e.POST(sessionsRevokePath, userSessions.revokeHandler)
+	e.POST(iconsResetPath, icons.resetHandler)
 
 	// stats
 	// ライブ配信統計情報
@@ -304,24 +346,65 @@ func main() {
 	powerDNSSubdomainAddress = subdomainAddr
 
 	// dns
+	dnsSyncInterval, err := dnsSyncIntervalFromEnv()
+	if err != nil {
+		e.Logger.Errorf("failed to load dns sync config: %v", err)
+		os.Exit(1)
+	}
+	shards, err := userShardsFromEnv()
+	if err != nil {
+		e.Logger.Errorf("failed to load user shards: %v", err)
+		os.Exit(1)
+	}
+	shardSet, err := newDNSShardSet(dbConfig, shards)
+	if err != nil {
+		e.Logger.Errorf("failed to load user shards: %v", err)
+		os.Exit(1)
+	}
+	userShards.SetShards(shardSet)
+	// ゾーンが変わったらセカンダリに通知する
+	for _, zone := range hostedZones {
+		if err := zone.restoreSerial(dnsSerialDir(), func(err error) {
+			e.Logger.Warnf("failed to save dns serial of %s: %v", zone.origin, err)
+		}); err != nil {
+			e.Logger.Errorf("failed to restore dns serial: %v", err)
+			os.Exit(1)
+		}
+		notifier := newZoneNotifier(zone)
+		zone.names.onChange = notifier.Notify
+		go notifier.Run()
+	}
+
 	err = initializeDnsCache(false)
 	if err != nil {
 		e.Logger.Errorf("failed to initialize dns cache: %v", err)
 		os.Exit(1)
 	}
 
+	go dnsSync.RunPoller(dnsSyncInterval, e.Logger)
+	go icons.RunSweeper(iconsSweepInterval, e.Logger)
+	for _, zone := range hostedZones {
+		go zone.RunPoller(dnsSyncInterval, e.Logger)
+	}
+
 	// DNSクエリハンドラーを登録
-	dns.HandleFunc(domain, echoHandler)
+	go dnsQueryLog.Run()
+	handler := dnsMetrics.Middleware(dnsQueryLog.Middleware(dnsRRL.Middleware(echoHandler)))
+	for _, zone := range hostedZones {
+		dns.HandleFunc(zone.origin, handler)
+	}
 
-	// UDP でリッスン開始（go ルーチン）
-	udpSrv := &dns.Server{Addr: addr, Net: "udp"}
-	defer udpSrv.Shutdown()
-	go serveDNS(udpSrv)
+	for _, addr := range dnsListenAddrs {
+		// UDP でリッスン開始（go ルーチン）
+		udpSrv := &dns.Server{Addr: addr, Net: "udp", TsigSecret: dnsTsigSecret}
+		defer udpSrv.Shutdown()
+		go serveDNS(udpSrv)
 
-	// TCP でリッスン開始（go ルーチン）
-	tcpSrv := &dns.Server{Addr: addr, Net: "tcp"}
-	defer tcpSrv.Shutdown()
-	go serveDNS(tcpSrv)
+		// TCP でリッスン開始（go ルーチン）
+		tcpSrv := &dns.Server{Addr: addr, Net: "tcp", TsigSecret: dnsTsigSecret}
+		defer tcpSrv.Shutdown()
+		go serveDNS(tcpSrv)
+	}
 
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
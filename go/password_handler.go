@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// パスワードの変更と再設定。
+// 再設定のトークンは一度だけ使え、passwordResetTokenTTL で期限が切れる。DBにはトークンのハッシュだけを保存する。
+// トークンは passwordResetNotifier でユーザに届ける。ISUCON13_PASSWORD_RESET_WEBHOOK を設定すると、そのURLにPOSTする。
+// パスワードを変更したら、そのユーザの他のセッションはすべて失効させる。
+const (
+	passwordResetWebhookEnvKey = "ISUCON13_PASSWORD_RESET_WEBHOOK"
+
+	passwordResetTokenTTL = 30 * time.Minute
+	// passwordResetInterval の間は同じユーザにトークンを送り直さない
+	passwordResetInterval = 1 * time.Minute
+
+	passwordMinLength = 8
+	// passwordMaxLength はbcryptが扱えるバイト数の上限です
+	passwordMaxLength = 72
+)
+
+var resetNotifier = newPasswordResetNotifierFromEnv()
+
+var errPasswordResetUnavailable = errors.New("password reset is not available")
+
+type PasswordResetTokenModel struct {
+	TokenHash string `db:"token_hash"`
+	UserID    int64  `db:"user_id"`
+	CreatedAt int64  `db:"created_at"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+type PutPasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// PasswordResetNotification は再設定のトークンをユーザに届けるための内容です
+type PasswordResetNotification struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// passwordResetNotifier は再設定のトークンをユーザに届けます
+type passwordResetNotifier interface {
+	NotifyPasswordReset(ctx context.Context, n PasswordResetNotification) error
+}
+
+func newPasswordResetNotifierFromEnv() passwordResetNotifier {
+	if url := os.Getenv(passwordResetWebhookEnvKey); url != "" {
+		return &webhookPasswordResetNotifier{url: url, client: &http.Client{Timeout: dnsSyncPushTimeout}}
+	}
+	return disabledPasswordResetNotifier{}
+}
+
+// webhookPasswordResetNotifier はメールなどを送る外部のサービスに通知をPOSTします
+type webhookPasswordResetNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookPasswordResetNotifier) NotifyPasswordReset(ctx context.Context, n PasswordResetNotification) error {
+	b, err := json.Marshal(&n)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", echo.MIMEApplicationJSON)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to post notification: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// disabledPasswordResetNotifier は届け先が設定されていないときに使います
+type disabledPasswordResetNotifier struct{}
+
+func (disabledPasswordResetNotifier) NotifyPasswordReset(context.Context, PasswordResetNotification) error {
+	return errPasswordResetUnavailable
+}
+
+// validateNewPassword は新しいパスワードの長さを確かめます
+func validateNewPassword(password string) error {
+	if len(password) < passwordMinLength {
+		return fmt.Errorf("new_password must be at least %d characters", passwordMinLength)
+	}
+	if len(password) > passwordMaxLength {
+		return fmt.Errorf("new_password must be at most %d bytes", passwordMaxLength)
+	}
+	return nil
+}
+
+// newPasswordResetToken はトークンと、DBに保存するそのハッシュを返します
+func newPasswordResetToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, passwordResetTokenHashOf(token), nil
+}
+
+func passwordResetTokenHashOf(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// revokeOtherSessions はパスワードを変更したユーザの except 以外のセッションを失効させます
+func revokeOtherSessions(c echo.Context, userID int64, except string) error {
+	ctx := c.Request().Context()
+	ids, err := userSessions.RevokeUser(ctx, userID, except)
+	if err != nil {
+		return err
+	}
+	if err := userSessions.NotifyRevoked(ctx, ids...); err != nil {
+		c.Logger().Warnf("failed to notify revoked sessions to peers: %v", err)
+	}
+	return nil
+}
+
+// パスワード変更API
+// PUT /api/user/me/password
+func putPasswordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	req := PutPasswordRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateNewPassword(req.NewPassword); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	userModel := UserModel{}
+	if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	// 今のパスワードの総当たりもログインと同じように制限する
+	attempt, wait, err := reserveLoginAttempt(ctx, loginThrottleKeys(c, userModel.Name))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if wait > 0 {
+		return tooManyLoginAttempts(c, wait)
+	}
+	defer releaseLoginAttempt(c, attempt)
+	err = comparePassword(ctx, userModel.HashedPassword, req.CurrentPassword)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		if err := attempt.Fail(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "current_password is wrong")
+	}
+	if errors.Is(err, errPasswordHashBusy) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+	}
+
+	hashedPassword, err := hashPassword(ctx, req.NewPassword)
+	if errors.Is(err, errPasswordHashBusy) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+	}
+	if _, err := dbConn.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update password: "+err.Error())
+	}
+
+	// 変更した本人のセッションは残す
+	if err := revokeOtherSessions(c, userID, sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// パスワード再設定のトークン発行API
+// POST /api/password-reset
+// ユーザが存在するかどうかを知られないよう、常に 202 を返す
+func postPasswordResetHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	req := PasswordResetRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateUsername(req.Username); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if _, ok := resetNotifier.(disabledPasswordResetNotifier); ok {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, errPasswordResetUnavailable.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ? FOR UPDATE", req.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.NoContent(http.StatusAccepted)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	now := time.Now()
+	var recent int
+	if err := tx.GetContext(ctx, &recent, "SELECT COUNT(*) FROM password_reset_tokens WHERE user_id = ? AND created_at > ?", userModel.ID, now.Add(-passwordResetInterval).Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reset tokens: "+err.Error())
+	}
+	if recent > 0 {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	token, tokenHash, err := newPasswordResetToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	tokenModel := PasswordResetTokenModel{
+		TokenHash: tokenHash,
+		UserID:    userModel.ID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(passwordResetTokenTTL).Unix(),
+	}
+	// 使えるのは最後に発行したトークンだけにする
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_reset_tokens WHERE user_id = ?", userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reset tokens: "+err.Error())
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at) VALUES (:token_hash, :user_id, :created_at, :expires_at)", tokenModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reset token: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := resetNotifier.NotifyPasswordReset(ctx, PasswordResetNotification{
+		UserID:    userModel.ID,
+		Username:  userModel.Name,
+		Token:     token,
+		ExpiresAt: tokenModel.ExpiresAt,
+	}); err != nil {
+		// エラーを返すとユーザが存在することが分かってしまうので、記録だけする
+		c.Logger().Warnf("failed to notify reset token: %v", err)
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// パスワード再設定API
+// POST /api/password-reset/confirm
+func postPasswordResetConfirmHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	req := PasswordResetConfirmRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateNewPassword(req.NewPassword); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// 誰でも呼べるので、無効なトークンでbcryptのワーカーを使い切られないよう、ハッシュする前にトークンを確かめる。
+	// bcryptの間トークンの行はロックしないので、トランザクションの中でもう一度確かめる。
+	tokenHash := passwordResetTokenHashOf(req.Token)
+	tokenModel := PasswordResetTokenModel{}
+	if err := passwordResetTokenError(&tokenModel, dbConn.GetContext(ctx, &tokenModel, "SELECT * FROM password_reset_tokens WHERE token_hash = ?", tokenHash)); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(ctx, req.NewPassword)
+	if errors.Is(err, errPasswordHashBusy) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// ハッシュしている間に同じトークンが使われたり、期限が切れたりしていないか
+	if err := passwordResetTokenError(&tokenModel, tx.GetContext(ctx, &tokenModel, "SELECT * FROM password_reset_tokens WHERE token_hash = ? FOR UPDATE", tokenHash)); err != nil {
+		return err
+	}
+
+	// 一度使ったトークンは消す
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_reset_tokens WHERE token_hash = ?", tokenModel.TokenHash); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reset token: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), tokenModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update password: "+err.Error())
+	}
+	var userName string
+	if err := tx.GetContext(ctx, &userName, "SELECT name FROM users WHERE id = ?", tokenModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// パスワードを忘れた本人もログインし直すので、すべてのセッションを失効させる
+	if err := revokeOtherSessions(c, tokenModel.UserID, ""); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+	// 再設定できたのでロックも解く
+	if err := resetLoginFailures(ctx, loginThrottleKeys(c, userName)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// passwordResetTokenError はトークンを引いた結果 err から、使えないトークンなら返すエラーを作ります
+func passwordResetTokenError(tokenModel *PasswordResetTokenModel, err error) error {
+	if errors.Is(err, sql.ErrNoRows) || err == nil && time.Now().Unix() > tokenModel.ExpiresAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "the token is invalid or has expired")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reset token: "+err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recordingPasswordResetNotifier はテストでメールの代わりにトークンを受け取ります
+type recordingPasswordResetNotifier struct {
+	mu            sync.Mutex
+	notifications []PasswordResetNotification
+}
+
+func (r *recordingPasswordResetNotifier) NotifyPasswordReset(_ context.Context, n PasswordResetNotification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func TestWebhookPasswordResetNotifier(t *testing.T) {
+	received := &recordingPasswordResetNotifier{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n PasswordResetNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received.NotifyPasswordReset(r.Context(), n)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv(passwordResetWebhookEnvKey, server.URL)
+	notifier := newPasswordResetNotifierFromEnv()
+
+	token, tokenHash, err := newPasswordResetToken()
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	n := PasswordResetNotification{UserID: 1, Username: "alice", Token: token, ExpiresAt: 1700000000}
+	if err := notifier.NotifyPasswordReset(context.Background(), n); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	if len(received.notifications) != 1 || received.notifications[0] != n {
+		t.Errorf("unexpected notifications: %+v", received.notifications)
+	}
+	// DBにはトークンそのものを保存しない
+	if tokenHash == token || tokenHash != passwordResetTokenHashOf(token) {
+		t.Errorf("the token must be stored as its hash")
+	}
+
+	// 届け先が無ければ再設定はできない
+	t.Setenv(passwordResetWebhookEnvKey, "")
+	if err := newPasswordResetNotifierFromEnv().NotifyPasswordReset(context.Background(), n); !errors.Is(err, errPasswordResetUnavailable) {
+		t.Errorf("want errPasswordResetUnavailable, got %v", err)
+	}
+}
+
+func TestNewPasswordResetToken(t *testing.T) {
+	a, _, _ := newPasswordResetToken()
+	b, _, _ := newPasswordResetToken()
+	if a == b || len(a) < 43 {
+		t.Errorf("tokens must be random and long enough: %q %q", a, b)
+	}
+}
+
+func TestValidateNewPassword(t *testing.T) {
+	if err := validateNewPassword("correct horse"); err != nil {
+		t.Errorf("must be valid: %v", err)
+	}
+	for _, password := range []string{"", "short", strings.Repeat("a", passwordMaxLength+1)} {
+		if err := validateNewPassword(password); err == nil {
+			t.Errorf("%q must be invalid", password)
+		}
+	}
+}
+
+func TestPasswordResetTokenError(t *testing.T) {
+	now := time.Now().Unix()
+	for _, tt := range []struct {
+		expiresAt int64
+		err       error
+		want      int
+	}{
+		{expiresAt: now + 60, want: 0},
+		{expiresAt: now - 1, want: http.StatusBadRequest},
+		{err: sql.ErrNoRows, want: http.StatusBadRequest},
+		{err: errors.New("connection refused"), want: http.StatusInternalServerError},
+	} {
+		err := passwordResetTokenError(&PasswordResetTokenModel{ExpiresAt: tt.expiresAt}, tt.err)
+		got := 0
+		if he, ok := err.(*echo.HTTPError); ok {
+			got = he.Code
+		} else if err != nil {
+			got = -1
+		}
+		if got != tt.want {
+			t.Errorf("expires_at=%d, err=%v: want %d, got %v", tt.expiresAt, tt.err, tt.want, err)
+		}
+	}
+}
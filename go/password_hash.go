@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// パスワードのハッシュ。
+// bcryptのコストは ISUCON13_BCRYPT_COST で変えられる。ベンチマークの速さのため既定は bcrypt.MinCost のまま。
+// コストを上げても、低いコストで保存されたハッシュはログインに成功したときに今のコストでハッシュし直す。
+// bcryptは重いので、同時に実行する数を ISUCON13_BCRYPT_WORKERS に制限し、ログインが集中しても他のAPIが動けるようにする。
+const (
+	bcryptCostEnvKey    = "ISUCON13_BCRYPT_COST"
+	bcryptWorkersEnvKey = "ISUCON13_BCRYPT_WORKERS"
+
+	// passwordHashQueueTimeout だけ待っても空かなければ諦める
+	passwordHashQueueTimeout = 5 * time.Second
+)
+
+var (
+	bcryptCost = bcryptDefaultCost
+	// passwordHashers はbcryptを実行している数のセマフォです
+	passwordHashers = make(chan struct{}, defaultBcryptWorkers())
+)
+
+var errPasswordHashBusy = errors.New("too many password hashing requests")
+
+// defaultBcryptWorkers はCPUの半分で、残りを他のAPIに残す
+func defaultBcryptWorkers() int {
+	return max(runtime.NumCPU()/2, 1)
+}
+
+// loadPasswordHashConfig は環境変数からbcryptのコストと同時実行数を読みます
+func loadPasswordHashConfig() error {
+	if v := os.Getenv(bcryptCostEnvKey); v != "" {
+		cost, err := strconv.Atoi(v)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return fmt.Errorf("%s must be between %d and %d: %q", bcryptCostEnvKey, bcrypt.MinCost, bcrypt.MaxCost, v)
+		}
+		bcryptCost = cost
+	}
+	if v := os.Getenv(bcryptWorkersEnvKey); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil || workers <= 0 {
+			return fmt.Errorf("%s must be a positive integer: %q", bcryptWorkersEnvKey, v)
+		}
+		passwordHashers = make(chan struct{}, workers)
+	}
+	return nil
+}
+
+// withPasswordHasher は空きを待ってから f を実行します
+func withPasswordHasher(ctx context.Context, f func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, passwordHashQueueTimeout)
+	defer cancel()
+
+	hashers := passwordHashers
+	select {
+	case hashers <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", errPasswordHashBusy, ctx.Err())
+	}
+	defer func() { <-hashers }()
+
+	return f()
+}
+
+// hashPassword は今のコストでパスワードをハッシュします
+func hashPassword(ctx context.Context, password string) ([]byte, error) {
+	var hashed []byte
+	err := withPasswordHasher(ctx, func() (err error) {
+		hashed, err = bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		return err
+	})
+	return hashed, err
+}
+
+// comparePassword はパスワードがハッシュと一致するか確かめます。
+// 一致しなければ bcrypt.ErrMismatchedHashAndPassword を返す。
+func comparePassword(ctx context.Context, hashed string, password string) error {
+	return withPasswordHasher(ctx, func() error {
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+	})
+}
+
+// passwordNeedsRehash はハッシュのコストが今のコストより低ければ true を返します
+func passwordNeedsRehash(hashed string) bool {
+	cost, err := bcrypt.Cost([]byte(hashed))
+	return err == nil && cost < bcryptCost
+}
+
+// rehashPassword は今のコストでハッシュし直して保存します。
+// 間にパスワードが変更されていたら上書きしない。
+func rehashPassword(ctx context.Context, user UserModel, password string) error {
+	hashed, err := hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	if _, err := dbConn.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ? AND password = ?", string(hashed), user.ID, user.HashedPassword); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	t.Cleanup(func() { bcryptCost = bcryptDefaultCost })
+
+	bcryptCost = bcrypt.MinCost
+	hashed, err := hashPassword(context.Background(), "s3cret")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	if passwordNeedsRehash(string(hashed)) {
+		t.Errorf("a hash with the current cost must not be rehashed")
+	}
+	if err := comparePassword(context.Background(), string(hashed), "s3cret"); err != nil {
+		t.Errorf("the password must match: %v", err)
+	}
+
+	// コストを上げると、古いハッシュはハッシュし直す
+	bcryptCost = bcrypt.MinCost + 1
+	if !passwordNeedsRehash(string(hashed)) {
+		t.Errorf("a hash with a lower cost must be rehashed")
+	}
+	if passwordNeedsRehash("not a hash") {
+		t.Errorf("an invalid hash must not be rehashed")
+	}
+}
+
+func TestWithPasswordHasher(t *testing.T) {
+	orig := passwordHashers
+	t.Cleanup(func() { passwordHashers = orig })
+	passwordHashers = make(chan struct{}, 1)
+
+	// 空きが無ければ待ち、諦めたら errPasswordHashBusy を返す
+	started, release := make(chan struct{}), make(chan struct{})
+	go withPasswordHasher(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := withPasswordHasher(ctx, func() error { return nil }); !errors.Is(err, errPasswordHashBusy) {
+		t.Errorf("want errPasswordHashBusy, got %v", err)
+	}
+
+	close(release)
+	if err := withPasswordHasher(context.Background(), func() error { return nil }); err != nil {
+		t.Errorf("the released worker must be reused: %v", err)
+	}
+}
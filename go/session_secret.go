@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// セッションCookieの署名鍵。
+// ISUCON13_SESSION_SECRETKEY で署名し、ISUCON13_SESSION_PREVIOUS_SECRETKEYS (カンマ区切り) の鍵で署名されたCookieも受け付ける。
+// 鍵を入れ替えるときは、今の鍵を PREVIOUS に移してから新しい鍵を設定すれば、ログイン中のユーザはログアウトされない。
+// 古い鍵で署名されたCookieは、次のリクエストで新しい鍵で署名し直す。
+const (
+	sessionSecretEnvKey          = "ISUCON13_SESSION_SECRETKEY"
+	sessionPreviousSecretsEnvKey = "ISUCON13_SESSION_PREVIOUS_SECRETKEYS"
+	// sessionAllowDefaultSecretEnvKey を true にしたときだけ、既定の鍵で起動できる (開発用)
+	sessionAllowDefaultSecretEnvKey = "ISUCON13_SESSION_ALLOW_DEFAULT_SECRETKEY"
+
+	defaultSessionSecret = "isucon13_session_cookiestore_defaultsecret"
+)
+
+var (
+	secret          = []byte(defaultSessionSecret)
+	previousSecrets [][]byte
+)
+
+// loadSessionSecrets は環境変数から署名鍵を読みます。
+// 既定の鍵はソースコードに書かれていて誰でもCookieを偽造できるので、開発用のフラグが無ければエラーにする。
+func loadSessionSecrets() error {
+	if v, ok := os.LookupEnv(sessionSecretEnvKey); ok && v != "" {
+		secret = []byte(v)
+	}
+	previousSecrets = nil
+	for _, v := range strings.Split(os.Getenv(sessionPreviousSecretsEnvKey), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			previousSecrets = append(previousSecrets, []byte(v))
+		}
+	}
+
+	if string(secret) == defaultSessionSecret {
+		allow, _ := strconv.ParseBool(os.Getenv(sessionAllowDefaultSecretEnvKey))
+		if !allow {
+			return fmt.Errorf("%s is not set; set %s=true to use the default key for development", sessionSecretEnvKey, sessionAllowDefaultSecretEnvKey)
+		}
+	}
+	return nil
+}
+
+// newCookieStore は secret で署名し、previousSecrets でも検証するCookieStoreを作ります
+func newCookieStore() *sessions.CookieStore {
+	// 暗号化はしないので、暗号化の鍵は nil にする
+	keyPairs := [][]byte{secret, nil}
+	for _, s := range previousSecrets {
+		keyPairs = append(keyPairs, s, nil)
+	}
+	return sessions.NewCookieStore(keyPairs...)
+}
+
+// resignSessionCookie は古い鍵で署名されたセッションCookieを、今の鍵で署名し直すミドルウェアです
+func resignSessionCookie(store *sessions.CookieStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if len(store.Codecs) > 1 && !signedWithCurrentSecret(c, store) {
+				// どの鍵でも検証できなければ IsNew になるので、何もしない
+				if sess, err := session.Get(defaultSessionIDKey, c); err == nil && !sess.IsNew {
+					sess.Options = sessionCookieOptions(sessionCookieMaxAge)
+					if err := sess.Save(c.Request(), c.Response()); err != nil {
+						c.Logger().Warnf("failed to resign session: %v", err)
+					}
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// signedWithCurrentSecret はセッションCookieが無いか、今の鍵で署名されていれば true を返します
+func signedWithCurrentSecret(c echo.Context, store *sessions.CookieStore) bool {
+	cookie, err := c.Cookie(defaultSessionIDKey)
+	if err != nil {
+		return true
+	}
+	values := map[any]any{}
+	return securecookie.DecodeMulti(cookie.Name, cookie.Value, &values, store.Codecs[0]) == nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoadSessionSecrets(t *testing.T) {
+	t.Cleanup(func() {
+		secret = []byte(defaultSessionSecret)
+		previousSecrets = nil
+	})
+
+	t.Setenv(sessionSecretEnvKey, "")
+	t.Setenv(sessionAllowDefaultSecretEnvKey, "")
+	if err := loadSessionSecrets(); err == nil {
+		t.Errorf("the default key must be refused without %s", sessionAllowDefaultSecretEnvKey)
+	}
+	t.Setenv(sessionAllowDefaultSecretEnvKey, "true")
+	if err := loadSessionSecrets(); err != nil {
+		t.Errorf("the default key must be allowed for development: %v", err)
+	}
+
+	t.Setenv(sessionAllowDefaultSecretEnvKey, "")
+	t.Setenv(sessionSecretEnvKey, "new")
+	t.Setenv(sessionPreviousSecretsEnvKey, "old, older,")
+	if err := loadSessionSecrets(); err != nil {
+		t.Fatalf("failed to load session secrets: %v", err)
+	}
+	if string(secret) != "new" || len(previousSecrets) != 2 || string(previousSecrets[1]) != "older" {
+		t.Errorf("unexpected secrets: %q %q", secret, previousSecrets)
+	}
+}
+
+// newSessionSecretTestServer は USERID を返すだけのAPIを持つサーバーです
+func newSessionSecretTestServer(t *testing.T, store *sessions.CookieStore) *echo.Echo {
+	t.Helper()
+	e := echo.New()
+	e.Use(session.Middleware(store))
+	e.Use(resignSessionCookie(store))
+	e.GET("/", func(c echo.Context) error {
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		userID, ok := sess.Values[defaultUserIDKey].(int64)
+		if !ok {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		return c.JSON(http.StatusOK, userID)
+	})
+	return e
+}
+
+func TestResignSessionCookie(t *testing.T) {
+	t.Cleanup(func() {
+		secret = []byte(defaultSessionSecret)
+		previousSecrets = nil
+	})
+
+	// 古い鍵でログインしたCookie
+	secret, previousSecrets = []byte("old"), nil
+	oldStore := newCookieStore()
+	sess := sessions.NewSession(oldStore, defaultSessionIDKey)
+	sess.Values[defaultUserIDKey] = int64(1)
+	oldCookie, err := oldStore.Codecs[0].Encode(defaultSessionIDKey, sess.Values)
+	if err != nil {
+		t.Fatalf("failed to encode session: %v", err)
+	}
+
+	secret, previousSecrets = []byte("new"), [][]byte{[]byte("old")}
+	e := newSessionSecretTestServer(t, newCookieStore())
+	get := func(value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: defaultSessionIDKey, Value: value})
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 古い鍵のCookieも受け付け、新しい鍵で署名し直す
+	rec := get(oldCookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("the cookie signed with the old key must be accepted: %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("want a resigned cookie, got %v", cookies)
+	}
+
+	// 署名し直したCookieは古い鍵を外しても使える
+	previousSecrets = nil
+	e = newSessionSecretTestServer(t, newCookieStore())
+	rec = get(cookies[0].Value)
+	if rec.Code != http.StatusOK {
+		t.Errorf("the resigned cookie must be accepted with the new key: %d", rec.Code)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("the cookie signed with the new key must not be resigned")
+	}
+
+	// どの鍵でもないCookieは受け付けない
+	if rec := get(oldCookie); rec.Code != http.StatusUnauthorized {
+		t.Errorf("the cookie signed with an unknown key must be rejected: %d", rec.Code)
+	}
+}
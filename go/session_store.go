@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// サーバー側のセッション。
+// CookieにはこれまでどおりセッションIDとユーザIDを署名して入れるが、有効かどうかは sessions テーブルで判断する。
+// これによりログアウトやパスワード変更でセッションを失効させられる。
+// 各ノードは sessionCacheTTL だけセッションをメモリに持つので、失効はピアにも通知して即座に反映させる。
+const (
+	sessionTTL = 1 * time.Hour
+	// sessionCookieMaxAge はCookieの寿命 (秒) で、有効期限は sessionTTL で判断する
+	sessionCookieMaxAge = 60000
+	// sessionCacheTTL は失効の通知を取りこぼしたノードでも、これだけ経てば失効が反映される時間です
+	sessionCacheTTL = 10 * time.Second
+
+	sessionsRevokePath = "/api/internal/sessions/revoke"
+)
+
+var userSessions = newSessionStore(dnsSync.peers, dnsSync.token)
+
+type SessionModel struct {
+	ID         string `db:"id"`
+	UserID     int64  `db:"user_id"`
+	UserAgent  string `db:"user_agent"`
+	RemoteAddr string `db:"remote_addr"`
+	CreatedAt  int64  `db:"created_at"`
+	ExpiresAt  int64  `db:"expires_at"`
+}
+
+type Session struct {
+	// ID はセッションIDそのものではなく、セッションを見分けるためのハッシュです
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	RemoteAddr string `json:"remote_addr"`
+	CreatedAt  int64  `json:"created_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	// Current はこのリクエストのセッションかどうかです
+	Current bool `json:"current"`
+}
+
+type SessionRevokeRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type sessionStore struct {
+	cache  *Cache[string, SessionModel]
+	peers  []string
+	token  string
+	client *http.Client
+}
+
+func newSessionStore(peers []string, token string) *sessionStore {
+	return &sessionStore{
+		cache:  NewCacheWithExpire[string, SessionModel](sessionCacheTTL, time.Minute),
+		peers:  peers,
+		token:  token,
+		client: &http.Client{Timeout: dnsSyncPushTimeout},
+	}
+}
+
+// Create はユーザの新しいセッションを作ります。ついでにそのユーザの期限切れのセッションを削除する。
+func (s *sessionStore) Create(ctx context.Context, userID int64, userAgent string, remoteAddr string) (SessionModel, error) {
+	now := time.Now()
+	sess := SessionModel{
+		ID:         uuid.NewString(),
+		UserID:     userID,
+		UserAgent:  truncate(userAgent, 255),
+		RemoteAddr: truncate(remoteAddr, 64),
+		CreatedAt:  now.Unix(),
+		ExpiresAt:  now.Add(sessionTTL).Unix(),
+	}
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ? AND expires_at < ?", userID, now.Unix()); err != nil {
+		return SessionModel{}, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO sessions (id, user_id, user_agent, remote_addr, created_at, expires_at) VALUES (:id, :user_id, :user_agent, :remote_addr, :created_at, :expires_at)", sess); err != nil {
+		return SessionModel{}, fmt.Errorf("failed to insert session: %w", err)
+	}
+	s.cache.Set(sess.ID, sess)
+	return sess, nil
+}
+
+// Get は有効なセッションを返します。失効しているか期限切れなら false を返す。
+func (s *sessionStore) Get(ctx context.Context, id string) (SessionModel, bool, error) {
+	sess, ok := s.cache.Get(id)
+	if !ok {
+		err := dbConn.GetContext(ctx, &sess, "SELECT * FROM sessions WHERE id = ?", id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return SessionModel{}, false, nil
+		}
+		if err != nil {
+			return SessionModel{}, false, fmt.Errorf("failed to get session: %w", err)
+		}
+		s.cache.Set(id, sess)
+	}
+	if time.Now().Unix() > sess.ExpiresAt {
+		return SessionModel{}, false, nil
+	}
+	return sess, true, nil
+}
+
+// List はユーザの有効なセッションを作成順に返します
+func (s *sessionStore) List(ctx context.Context, userID int64) ([]SessionModel, error) {
+	var sessions []SessionModel
+	if err := dbConn.SelectContext(ctx, &sessions, "SELECT * FROM sessions WHERE user_id = ? AND expires_at >= ? ORDER BY created_at, id", userID, time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("failed to select sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// Revoke はセッションを失効させます。ピアへの通知は NotifyRevoked で行う。
+func (s *sessionStore) Revoke(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("DELETE FROM sessions WHERE id IN (?)", ids)
+	if err != nil {
+		return fmt.Errorf("failed to build query: %w", err)
+	}
+	if _, err := dbConn.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	s.forget(ids)
+	return nil
+}
+
+// RevokeUser はユーザのセッションを except 以外すべて失効させ、失効させたセッションIDを返します。
+// パスワードを変更したときに呼ぶ。
+func (s *sessionStore) RevokeUser(ctx context.Context, userID int64, except string) ([]string, error) {
+	var ids []string
+	if err := dbConn.SelectContext(ctx, &ids, "SELECT id FROM sessions WHERE user_id = ? AND id != ?", userID, except); err != nil {
+		return nil, fmt.Errorf("failed to select sessions: %w", err)
+	}
+	return ids, s.Revoke(ctx, ids...)
+}
+
+// NotifyRevoked は失効したセッションをピアに通知し、キャッシュから消させます。
+// 届かなかったピアでも sessionCacheTTL 以内に反映されるので、エラーは返すがリトライはしない。
+func (s *sessionStore) NotifyRevoked(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(&SessionRevokeRequest{IDs: ids})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return callPeers(ctx, s.client, s.peers, s.token, http.MethodPost, sessionsRevokePath, echo.MIMEApplicationJSON, b)
+}
+
+func (s *sessionStore) forget(ids []string) {
+	for _, id := range ids {
+		s.cache.Delete(id)
+	}
+}
+
+// Flush はこのノードのキャッシュを捨てます
+func (s *sessionStore) Flush() {
+	s.cache.Flush()
+}
+
+// ピアから失効したセッションを通知されるAPI
+// POST /api/internal/sessions/revoke
+func (s *sessionStore) revokeHandler(c echo.Context) error {
+	if err := verifyInternalToken(c, s.token); err != nil {
+		return err
+	}
+	defer c.Request().Body.Close()
+
+	req := SessionRevokeRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	s.forget(req.IDs)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// sessionCookieOptions はセッションのCookieの属性です。maxAge が負ならCookieを削除する。
+func sessionCookieOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Domain: domain,
+		MaxAge: maxAge,
+		Path:   "/",
+	}
+}
+
+// currentSessionID はCookieのセッションIDを返します
+func currentSessionID(c echo.Context) (string, bool) {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return "", false
+	}
+	id, ok := sess.Values[defaultSessionIDKey].(string)
+	return id, ok
+}
+
+// sessionHandleOf はセッションIDを一覧に出すための値です。
+// 一覧のレスポンスが漏れてもセッションを乗っ取られないよう、ハッシュにして返す。
+func sessionHandleOf(id string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(id)))[:16]
+}
+
+// ログアウトAPI
+// POST /api/logout
+func logoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+	if id, ok := sess.Values[defaultSessionIDKey].(string); ok {
+		if err := userSessions.Revoke(ctx, id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke session: "+err.Error())
+		}
+		if err := userSessions.NotifyRevoked(ctx, id); err != nil {
+			c.Logger().Warnf("failed to notify revoked session to peers: %v", err)
+		}
+	}
+
+	sess.Options = sessionCookieOptions(-1)
+	sess.Values = map[any]any{}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 自分の有効なセッションの一覧API
+// GET /api/user/me/sessions
+func getMySessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	currentID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	models, err := userSessions.List(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	sessions := make([]Session, len(models))
+	for i, model := range models {
+		sessions[i] = Session{
+			ID:         sessionHandleOf(model.ID),
+			UserAgent:  model.UserAgent,
+			RemoteAddr: model.RemoteAddr,
+			CreatedAt:  model.CreatedAt,
+			ExpiresAt:  model.ExpiresAt,
+			Current:    model.ID == currentID,
+		}
+	}
+
+	return c.JSON(http.StatusOK, sessions)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
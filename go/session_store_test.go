@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSessionStore_NotifyRevoked(t *testing.T) {
+	peer := newSessionStore(nil, "secret")
+	e := echo.New()
+	e.POST(sessionsRevokePath, peer.revokeHandler)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	// ピアはログイン後にセッションをキャッシュしている
+	sess := SessionModel{ID: "revoked", UserID: 1, ExpiresAt: time.Now().Add(sessionTTL).Unix()}
+	peer.cache.Set(sess.ID, sess)
+	peer.cache.Set("alive", SessionModel{ID: "alive", UserID: 1, ExpiresAt: sess.ExpiresAt})
+
+	store := newSessionStore([]string{server.URL}, "another")
+	if err := store.NotifyRevoked(context.Background(), sess.ID); err == nil {
+		t.Errorf("notify must fail with an invalid token")
+	}
+
+	store.token = "secret"
+	if err := store.NotifyRevoked(context.Background(), sess.ID); err != nil {
+		t.Fatalf("failed to notify revoked session: %v", err)
+	}
+	if _, ok := peer.cache.Get(sess.ID); ok {
+		t.Errorf("the revoked session must be removed from the cache")
+	}
+	if _, ok := peer.cache.Get("alive"); !ok {
+		t.Errorf("other sessions must be kept")
+	}
+}
+
+func TestSessionHandleOf(t *testing.T) {
+	id := "6f1c0b5e-1d6a-4f0e-9a3c-2d8e7b4a5c10"
+	handle := sessionHandleOf(id)
+	if len(handle) != 16 || handle != sessionHandleOf(id) {
+		t.Errorf("want a stable 16 chars handle, got %q", handle)
+	}
+	if handle == sessionHandleOf("another") {
+		t.Errorf("different sessions must have different handles")
+	}
+}
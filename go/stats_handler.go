@@ -67,7 +67,10 @@ func getUserStatisticsHandler(c echo.Context) error {
 		return err
 	}
 
-	username := c.Param("username")
+	username, err := usernameParam(c)
+	if err != nil {
+		return err
+	}
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 配信者のチャンネルページのテーマ。
+// dark_mode に加えてアクセントカラー、背景色、バナー画像、文字の大きさを設定できる。
+// 空のフィールドはクライアントの既定の見た目を使い、JSONにも含めないので、dark_mode しか知らないクライアントもそのまま動く。
+const (
+	themeBannerURLMaxLength = 2048
+
+	// themeTextContrastMin は背景色と文字色のコントラスト比の下限で、WCAG AAの通常の文字の基準です
+	themeTextContrastMin = 4.5
+	// themeAccentContrastMin は背景色とアクセントカラーのコントラスト比の下限で、WCAG AAのUI部品の基準です
+	themeAccentContrastMin = 3.0
+)
+
+// themeFontScales は文字の大きさのプリセットです
+var themeFontScales = []string{"small", "medium", "large", "x-large"}
+
+var themeColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// themeTextColor はクライアントが dark_mode ごとに使う文字色です
+func themeTextColor(darkMode bool) string {
+	if darkMode {
+		return "#ffffff"
+	}
+	return "#000000"
+}
+
+// themeFromModel はテーマのレスポンスを作ります
+func themeFromModel(m ThemeModel) Theme {
+	return Theme{
+		ID:              m.ID,
+		DarkMode:        m.DarkMode,
+		AccentColor:     m.AccentColor,
+		BackgroundColor: m.BackgroundColor,
+		BannerURL:       m.BannerURL,
+		FontScale:       m.FontScale,
+	}
+}
+
+// normalizeThemeColor は "#RGB" や "#RRGGBB" を小文字の "#rrggbb" にそろえます。空はそのまま返す。
+func normalizeThemeColor(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if !themeColorPattern.MatchString(s) {
+		return "", fmt.Errorf("must be a hex colour such as #1e90ff: %q", s)
+	}
+	s = strings.ToLower(s)
+	if len(s) == 4 {
+		s = string([]byte{'#', s[1], s[1], s[2], s[2], s[3], s[3]})
+	}
+	return s, nil
+}
+
+// validateThemeBannerURL はバナー画像のURLを確かめます。空なら設定しない。
+func validateThemeBannerURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	if len(s) > themeBannerURLMaxLength {
+		return fmt.Errorf("must be at most %d bytes", themeBannerURLMaxLength)
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return errors.New("must be an https URL")
+	}
+	return nil
+}
+
+// validateThemeFontScale は文字の大きさがプリセットのどれかか確かめます。空なら既定の大きさを使う。
+func validateThemeFontScale(s string) error {
+	if s == "" || slices.Contains(themeFontScales, s) {
+		return nil
+	}
+	return fmt.Errorf("must be one of %v", themeFontScales)
+}
+
+// validateThemeContrast は組み合わせたときに読めない色になっていないか確かめます
+func validateThemeContrast(m ThemeModel) error {
+	background := m.BackgroundColor
+	if background == "" {
+		// 背景色を設定しなければ、dark_mode の既定の背景に対してアクセントカラーを確かめる
+		background = themeTextColor(!m.DarkMode)
+	}
+	var errs []error
+	if m.BackgroundColor != "" {
+		if ratio := themeContrastRatio(background, themeTextColor(m.DarkMode)); ratio < themeTextContrastMin {
+			errs = append(errs, fmt.Errorf("background_color: contrast with the text must be at least %.1f:1, got %.2f:1", themeTextContrastMin, ratio))
+		}
+	}
+	if m.AccentColor != "" {
+		if ratio := themeContrastRatio(background, m.AccentColor); ratio < themeAccentContrastMin {
+			errs = append(errs, fmt.Errorf("accent_color: contrast with the background must be at least %.1f:1, got %.2f:1", themeAccentContrastMin, ratio))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// themeContrastRatio は "#rrggbb" の2色のWCAGのコントラスト比です
+func themeContrastRatio(a string, b string) float64 {
+	la, lb := themeLuminance(a), themeLuminance(b)
+	return (max(la, lb) + 0.05) / (min(la, lb) + 0.05)
+}
+
+// themeLuminance は "#rrggbb" のWCAGの相対輝度です
+func themeLuminance(color string) float64 {
+	var l float64
+	for i, weight := range []float64{0.2126, 0.7152, 0.0722} {
+		v, _ := strconv.ParseUint(color[1+i*2:3+i*2], 16, 8)
+		c := float64(v) / 255
+		if c <= 0.03928 {
+			c /= 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		l += weight * c
+	}
+	return l
+}
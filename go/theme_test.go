@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeThemeColor(t *testing.T) {
+	for in, want := range map[string]string{
+		"":        "",
+		"#1E90FF": "#1e90ff",
+		"#abc":    "#aabbcc",
+	} {
+		if got, err := normalizeThemeColor(in); err != nil || got != want {
+			t.Errorf("%q: want %q, got %q (err=%v)", in, want, got, err)
+		}
+	}
+	for _, in := range []string{"1e90ff", "#1e90f", "#gggggg", "red", "#1e90ff00"} {
+		if _, err := normalizeThemeColor(in); err == nil {
+			t.Errorf("%q must be invalid", in)
+		}
+	}
+}
+
+func TestThemeContrastRatio(t *testing.T) {
+	if got := themeContrastRatio("#000000", "#ffffff"); math.Abs(got-21) > 0.01 {
+		t.Errorf("black on white must be 21:1, got %.2f", got)
+	}
+	if got := themeContrastRatio("#777777", "#777777"); got != 1 {
+		t.Errorf("the same colours must be 1:1, got %.2f", got)
+	}
+}
+
+func TestValidateThemeContrast(t *testing.T) {
+	for _, m := range []ThemeModel{
+		{},
+		{DarkMode: true, BackgroundColor: "#1a1a2e", AccentColor: "#ffcc00"},
+		// 背景色が無ければ dark_mode の既定の背景 (白) に対して確かめる
+		{AccentColor: "#0050b3"},
+	} {
+		if err := validateThemeContrast(m); err != nil {
+			t.Errorf("%+v must be valid: %v", m, err)
+		}
+	}
+	for _, tt := range []struct {
+		m    ThemeModel
+		want string
+	}{
+		// 白い文字に明るい背景
+		{m: ThemeModel{DarkMode: true, BackgroundColor: "#eeeeee"}, want: "background_color"},
+		{m: ThemeModel{BackgroundColor: "#ffffff", AccentColor: "#ffff00"}, want: "accent_color"},
+		{m: ThemeModel{DarkMode: true, AccentColor: "#000033"}, want: "accent_color"},
+	} {
+		if err := validateThemeContrast(tt.m); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: want an error about %s, got %v", tt.m, tt.want, err)
+		}
+	}
+}
+
+func TestValidatePatchUserRequest_Theme(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	req := PatchUserRequest{Theme: &PatchUserRequestTheme{
+		AccentColor:     str("#ABC"),
+		BackgroundColor: str(""),
+		BannerURL:       str("https://example.com/banner.jpg"),
+		FontScale:       str("large"),
+	}}
+	if err := validatePatchUserRequest(req); err != nil {
+		t.Fatalf("must be valid: %v", err)
+	}
+	m := ThemeModel{BackgroundColor: "#ffffff"}
+	applyPatchUserRequestTheme(&m, *req.Theme)
+	if m.AccentColor != "#aabbcc" || m.BackgroundColor != "" || m.FontScale != "large" {
+		t.Errorf("unexpected theme: %+v", m)
+	}
+
+	err := validatePatchUserRequest(PatchUserRequest{Theme: &PatchUserRequestTheme{
+		AccentColor: str("blue"),
+		BannerURL:   str("http://example.com/banner.jpg"),
+		FontScale:   str("huge"),
+	}})
+	for _, want := range []string{"theme.accent_color", "theme.banner_url", "theme.font_scale"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want an error about %s, got %v", want, err)
+		}
+	}
+}
+
+func TestTheme_BackwardCompatibleJSON(t *testing.T) {
+	// 設定していなければ、これまでと同じJSONになる
+	b, err := json.Marshal(themeFromModel(ThemeModel{ID: 1, DarkMode: true}))
+	if err != nil {
+		t.Fatalf("failed to marshal theme: %v", err)
+	}
+	if got := string(b); got != `{"id":1,"dark_mode":true}` {
+		t.Errorf("unexpected json: %s", got)
+	}
+}
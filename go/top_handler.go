@@ -63,7 +63,10 @@ func getStreamerThemeHandler(c echo.Context) error {
 		return err
 	}
 
-	username := c.Param("username")
+	username, err := usernameParam(c)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -89,10 +92,5 @@ func getStreamerThemeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	theme := Theme{
-		ID:       themeModel.ID,
-		DarkMode: themeModel.DarkMode,
-	}
-
-	return c.JSON(http.StatusOK, theme)
+	return c.JSON(http.StatusOK, themeFromModel(themeModel))
 }
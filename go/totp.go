@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 のTOTP (HMAC-SHA1、30秒、6桁)。
+// Google Authenticatorなどの認証アプリが対応している既定の設定にそろえる。
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew は時計のずれを許すステップ数で、前後30秒のコードも受け付ける
+	totpSkew        = 1
+	totpSecretBytes = 20
+	totpIssuer      = "ISUPipe"
+
+	totpRecoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret は認証アプリに登録する秘密鍵をbase32で返します
+func newTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpProvisioningURI は認証アプリにQRコードで読み込ませるURIです
+func totpProvisioningURI(secret string, username string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// totpStep は t の時刻のステップ (Unix時間を30秒で割ったもの) です
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// totpCode は step のコードを返します (RFC 4226 のHOTP)
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// verifyTOTP は code が now の前後 totpSkew ステップのどれかと一致すれば、そのステップを返します。
+// 同じコードを使い回されないよう、呼び出し側は返したステップより前のコードを受け付けないようにする。
+func verifyTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes は認証アプリを失くしたときに一度ずつ使えるコードを作ります
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, totpRecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = s[:4] + "-" + s[4:]
+	}
+	return codes, nil
+}
+
+// recoveryCodeHashOf はDBに保存するリカバリーコードのハッシュです。大文字小文字やハイフンの有無は区別しない。
+func recoveryCodeHashOf(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(normalized)))
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// TOTPによる二段階認証 (任意)。
+// 登録してからコードを一度確かめると有効になり、そのときにリカバリーコードを一度だけ返す。
+// 有効なユーザのログインは二段階になり、パスワードが合うとクッキーには PENDING_USERID だけを保存する。
+// USERID を保存するのは POST /api/login/totp でコードかリカバリーコードが合ってから。
+const (
+	pendingTOTPUserIDKey  = "PENDING_USERID"
+	pendingTOTPExpiresKey = "PENDING_EXPIRES"
+
+	// totpPendingLoginTTL の間に二段階目を済ませないと、パスワードから入力し直しになる
+	totpPendingLoginTTL = 5 * time.Minute
+)
+
+type UserTOTPModel struct {
+	UserID       int64  `db:"user_id"`
+	Secret       string `db:"secret"`
+	Enabled      bool   `db:"enabled"`
+	LastUsedStep int64  `db:"last_used_step"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+// TOTPCodeRequest はコードかリカバリーコードのどちらかを指定します
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TOTPRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TOTPLoginResponse struct {
+	TOTPRequired bool `json:"totp_required"`
+}
+
+// isTOTPEnabled はユーザがTOTPを有効にしているかを返します
+func isTOTPEnabled(ctx context.Context, userID int64) (bool, error) {
+	var enabled bool
+	err := dbConn.GetContext(ctx, &enabled, "SELECT enabled FROM user_totp WHERE user_id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// startPendingTOTPLogin はパスワードが合ったユーザを二段階目の入力待ちにします
+func startPendingTOTPLogin(c echo.Context, userModel UserModel) error {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+
+	// 前にログインしていたユーザのままにならないよう、すべて消してから保存する
+	sess.Options = sessionCookieOptions(sessionCookieMaxAge)
+	sess.Values = map[any]any{
+		pendingTOTPUserIDKey:  userModel.ID,
+		pendingTOTPExpiresKey: time.Now().Add(totpPendingLoginTTL).Unix(),
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, TOTPLoginResponse{TOTPRequired: true})
+}
+
+// consumeSecondFactor はコードかリカバリーコードを確かめ、合っていれば使用済みにします
+func consumeSecondFactor(ctx context.Context, tx *sqlx.Tx, userID int64, req TOTPCodeRequest) (bool, error) {
+	if req.RecoveryCode != "" {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = ? AND code_hash = ?", userID, recoveryCodeHashOf(req.RecoveryCode))
+		if err != nil {
+			return false, err
+		}
+		n, err := rs.RowsAffected()
+		return n == 1, err
+	}
+
+	totpModel := UserTOTPModel{}
+	err := tx.GetContext(ctx, &totpModel, "SELECT * FROM user_totp WHERE user_id = ? AND enabled = TRUE FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	step, ok := verifyTOTP(totpModel.Secret, req.Code, time.Now())
+	// 一度受け付けたステップ以前のコードは使い回しとみなす
+	if !ok || step <= totpModel.LastUsedStep {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET last_used_step = ? WHERE user_id = ?", step, userID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// TOTP登録API
+// POST /api/user/me/totp
+func postTOTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	var enabled bool
+	err = tx.GetContext(ctx, &enabled, "SELECT enabled FROM user_totp WHERE user_id = ? FOR UPDATE", userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get totp: "+err.Error())
+	}
+	if enabled {
+		return echo.NewHTTPError(http.StatusConflict, "totp is already enabled")
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	// 確認が済んでいない登録はやり直せるよう、秘密鍵を置き換える
+	totpModel := UserTOTPModel{
+		UserID:    userID,
+		Secret:    secret,
+		CreatedAt: time.Now().Unix(),
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO user_totp (user_id, secret, enabled, last_used_step, created_at) VALUES (:user_id, :secret, :enabled, :last_used_step, :created_at) ON DUPLICATE KEY UPDATE secret = VALUES(secret), last_used_step = VALUES(last_used_step), created_at = VALUES(created_at)", totpModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert totp: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totpProvisioningURI(secret, userModel.Name),
+	})
+}
+
+// TOTP確認API
+// POST /api/user/me/totp/verify
+// 確認が済むとTOTPが有効になり、リカバリーコードを返す。リカバリーコードを見られるのはこのときだけ
+func postTOTPVerifyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	req := TOTPCodeRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	totpModel := UserTOTPModel{}
+	err = tx.GetContext(ctx, &totpModel, "SELECT * FROM user_totp WHERE user_id = ? FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "totp is not enrolled")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get totp: "+err.Error())
+	}
+	if totpModel.Enabled {
+		return echo.NewHTTPError(http.StatusConflict, "totp is already enabled")
+	}
+
+	step, ok := verifyTOTP(totpModel.Secret, req.Code, time.Now())
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "code is wrong")
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET enabled = TRUE, last_used_step = ? WHERE user_id = ?", step, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enable totp: "+err.Error())
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete recovery codes: "+err.Error())
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, recoveryCodeHashOf(code)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert recovery code: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 有効にする前にログインしていた他のセッションは、二段階目を済ませていないので失効させる
+	if err := revokeOtherSessions(c, userID, sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, TOTPRecoveryCodes{RecoveryCodes: codes})
+}
+
+// TOTP無効化API
+// DELETE /api/user/me/totp
+// 乗っ取られたセッションで外されないよう、コードかリカバリーコードを求める
+func deleteTOTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+
+	req := TOTPCodeRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	// コードの総当たりもログインと同じように制限する
+	attempt, wait, err := reserveLoginAttempt(ctx, loginThrottleKeys(c, username))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if wait > 0 {
+		return tooManyLoginAttempts(c, wait)
+	}
+	defer releaseLoginAttempt(c, attempt)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	ok, err := consumeSecondFactor(ctx, tx, userID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to verify code: "+err.Error())
+	}
+	if !ok {
+		if err := attempt.Fail(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "code is wrong")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete totp: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete recovery codes: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// ログインの二段階目API
+// POST /api/login/totp
+func postLoginTOTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+	userID, ok := sess.Values[pendingTOTPUserIDKey].(int64)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "no login is waiting for totp")
+	}
+	expires, _ := sess.Values[pendingTOTPExpiresKey].(int64)
+	if time.Now().Unix() > expires {
+		return echo.NewHTTPError(http.StatusUnauthorized, "login has expired")
+	}
+
+	req := TOTPCodeRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	userModel := UserModel{}
+	err = dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	// パスワードと同じ回数で締め出し、コードの総当たりを防ぐ
+	throttleKeys := loginThrottleKeys(c, userModel.Name)
+	attempt, wait, err := reserveLoginAttempt(ctx, throttleKeys)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if wait > 0 {
+		return tooManyLoginAttempts(c, wait)
+	}
+	defer releaseLoginAttempt(c, attempt)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	ok, err = consumeSecondFactor(ctx, tx, userID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to verify code: "+err.Error())
+	}
+	if !ok {
+		if err := attempt.Fail(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "code is wrong")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	releaseLoginAttempt(c, attempt)
+	if err := resetLoginFailures(ctx, throttleKeys); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := startUserSession(c, userModel); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B のSHA1のテストベクタの下6桁
+	key := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		if got := totpCode(key, totpStep(time.Unix(unix, 0))); got != want {
+			t.Errorf("T=%d: want %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("failed to generate secret: %v", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1700000000, 0)
+	current := totpStep(now)
+
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if got, ok := verifyTOTP(secret, totpCode(key, step), now); !ok || got != step {
+			t.Errorf("the code of step %d must be accepted at step %d: (%d, %v)", step, current, got, ok)
+		}
+	}
+	for _, code := range []string{totpCode(key, current-2), totpCode(key, current+2), "", "12345", "abcdef"} {
+		if _, ok := verifyTOTP(secret, code, now); ok {
+			t.Errorf("%q must be rejected", code)
+		}
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	u, err := url.Parse(totpProvisioningURI("JBSWY3DPEHPK3PXP", "alice"))
+	if err != nil {
+		t.Fatalf("failed to parse uri: %v", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/ISUPipe:alice" {
+		t.Errorf("unexpected uri: %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != totpIssuer || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected query: %v", q)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatalf("failed to generate recovery codes: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 9 || code[4] != '-' || seen[code] {
+			t.Errorf("unexpected recovery code: %q", code)
+		}
+		seen[code] = true
+	}
+	if len(codes) != totpRecoveryCodeCount {
+		t.Errorf("want %d codes, got %d", totpRecoveryCodeCount, len(codes))
+	}
+	// 入力のゆれは区別しない
+	if recoveryCodeHashOf("ABCD-EFGH") != recoveryCodeHashOf("abcdefgh") {
+		t.Errorf("recovery codes must be compared case- and hyphen-insensitively")
+	}
+}
@@ -1,22 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -33,12 +30,17 @@ const (
 
 var fallbackImage = "../img/NoImage.jpg"
 
+// iconImmutableCacheControl はハッシュで引くアイコンのCache-Controlです
+const iconImmutableCacheControl = "public, max-age=31536000, immutable"
+
 type UserModel struct {
 	ID             int64  `db:"id"`
 	Name           string `db:"name"`
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	// Version はプロフィールを変更するたびに増え、ETagとして使う
+	Version int64 `db:"version"`
 }
 
 type User struct {
@@ -53,12 +55,21 @@ type User struct {
 type Theme struct {
 	ID       int64 `json:"id"`
 	DarkMode bool  `json:"dark_mode"`
+	// 以下は設定されていなければ省略する
+	AccentColor     string `json:"accent_color,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	BannerURL       string `json:"banner_url,omitempty"`
+	FontScale       string `json:"font_scale,omitempty"`
 }
 
 type ThemeModel struct {
-	ID       int64 `db:"id"`
-	UserID   int64 `db:"user_id"`
-	DarkMode bool  `db:"dark_mode"`
+	ID              int64  `db:"id"`
+	UserID          int64  `db:"user_id"`
+	DarkMode        bool   `db:"dark_mode"`
+	AccentColor     string `db:"accent_color"`
+	BackgroundColor string `db:"background_color"`
+	BannerURL       string `db:"banner_url"`
+	FontScale       string `db:"font_scale"`
 }
 
 type PostUserRequest struct {
@@ -74,6 +85,22 @@ type PostUserRequestTheme struct {
 	DarkMode bool `json:"dark_mode"`
 }
 
+// PatchUserRequest は省略したフィールドを変更しない
+type PatchUserRequest struct {
+	DisplayName *string                `json:"display_name"`
+	Description *string                `json:"description"`
+	Theme       *PatchUserRequestTheme `json:"theme"`
+}
+
+// PatchUserRequestTheme の空文字列は設定を消して既定に戻す
+type PatchUserRequestTheme struct {
+	DarkMode        *bool   `json:"dark_mode"`
+	AccentColor     *string `json:"accent_color"`
+	BackgroundColor *string `json:"background_color"`
+	BannerURL       *string `json:"banner_url"`
+	FontScale       *string `json:"font_scale"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	// Password is non-hashed password.
@@ -88,8 +115,169 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
+// fallbackImageHash はアイコン未設定のユーザに返す fallbackImage のハッシュです
+var fallbackImageHash = sync.OnceValues(func() (string, error) {
+	image, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return "", err
+	}
+	return iconHashOf(image), nil
+})
+
+// fallbackIconVariants は fallbackImage の縮小版です
+var fallbackIconVariants = sync.OnceValues(func() (map[int][]byte, error) {
+	image, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return nil, err
+	}
+	return iconVariants(image)
+})
+
+// fallbackIcon は fallbackImage を size の大きさで返します
+func fallbackIcon(size int) ([]byte, error) {
+	if size == 0 {
+		return os.ReadFile(fallbackImage)
+	}
+	variants, err := fallbackIconVariants()
+	if err != nil {
+		return nil, err
+	}
+	return variants[size], nil
+}
+
+// iconETag は image_hash が hash のアイコンの size の大きさのETagです。縮小版は大きさごとに別のETagにする。
+func iconETag(hash string, size int) string {
+	if size == 0 {
+		return `"` + hash + `"`
+	}
+	return fmt.Sprintf(`"%s-%d"`, hash, size)
+}
+
+// iconImage は hash の画像を size の大きさで返します。無ければ os.ErrNotExist を返す。
+func iconImage(ctx context.Context, hash string, size int) ([]byte, error) {
+	if fallbackHash, err := fallbackImageHash(); err == nil && hash == fallbackHash {
+		return fallbackIcon(size)
+	}
+	return icons.Get(ctx, hash, size)
+}
+
+// アイコン取得API
+// ETagは icons.image_hash (User の icon_hash と同じ値) で、If-None-Match が一致すれば 304 を返す。
+// size に iconSizes のいずれかを指定すると縮小版を返す。
+// GET /api/user/:username/icon
 func getIconHandler(c echo.Context) error {
-	return c.JSON(http.StatusNotFound, "go icon handler called")
+	ctx := c.Request().Context()
+
+	username, err := usernameParam(c)
+	if err != nil {
+		return err
+	}
+	size, ok := parseIconSize(c.QueryParam("size"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("size must be one of %v", iconSizes))
+	}
+
+	var imageHash sql.NullString
+	if err := dbConn.GetContext(ctx, &imageHash, "SELECT icons.image_hash FROM users LEFT JOIN icons ON users.id = icons.user_id WHERE users.name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	fallbackHash, err := fallbackImageHash()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read fallback image: "+err.Error())
+	}
+	hash := fallbackHash
+	if imageHash.Valid {
+		hash = imageHash.String
+	}
+
+	etag := iconETag(hash, size)
+	c.Response().Header().Set("ETag", etag)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	image, err := iconImage(ctx, hash, size)
+	if errors.Is(err, os.ErrNotExist) {
+		// DBにも画像が残っていない場合は NoImage を返す。ETagもそちらに合わせる。
+		c.Response().Header().Set("ETag", iconETag(fallbackHash, size))
+		image, err = fallbackIcon(size)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read icon: "+err.Error())
+	}
+
+	return c.Blob(http.StatusOK, "image/jpeg", image)
+}
+
+// ハッシュ指定のアイコン取得API
+// User の icon_hash で引く。内容が変わらないので、ブラウザやCDNで永久にキャッシュさせる。
+// GET /api/icon/:hash
+func getIconByHashHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	hash := c.Param("hash")
+	if !iconHashPattern.MatchString(hash) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found icon that has the given hash")
+	}
+	size, ok := parseIconSize(c.QueryParam("size"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("size must be one of %v", iconSizes))
+	}
+
+	etag := iconETag(hash, size)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		c.Response().Header().Set("ETag", etag)
+		c.Response().Header().Set(echo.HeaderCacheControl, iconImmutableCacheControl)
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	image, err := iconImage(ctx, hash, size)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found icon that has the given hash")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read icon: "+err.Error())
+	}
+
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set(echo.HeaderCacheControl, iconImmutableCacheControl)
+	return c.Blob(http.StatusOK, "image/jpeg", image)
+}
+
+// etagMatches は If-None-Match の値 header に etag が含まれるかを返します。
+// If-None-Match は弱い比較なので W/ の有無は無視する。
+func etagMatches(header string, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatchesStrong は If-Match の値 header に etag が含まれるかを返します。
+// If-Match は強い比較なので、W/ の付いた弱いETagは一致しないものとする。
+func etagMatchesStrong(header string, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || !strings.HasPrefix(v, "W/") && v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchError は If-Match の値 header が etag に一致しなければ 412 を返します
+func ifMatchError(header string, etag string) error {
+	if !etagMatchesStrong(header, etag) {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "the profile has been modified")
+	}
+	return nil
 }
 
 func postIconHandler(c echo.Context) error {
@@ -114,9 +302,22 @@ func postIconHandler(c echo.Context) error {
 	}
 
 	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, iconMaxRequestBytes)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("image must be at most %d bytes", iconMaxBytes))
+		}
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
+	}
+
+	image, err := normalizeIcon(req.Image)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -124,46 +325,84 @@ func postIconHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+	iconID, garbage, err := replaceUserIcon(ctx, tx, userID, image)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	iconHash := sha256.Sum256(req.Image)
-	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image, image_hash) VALUES (?, ?, ?)", userID, []byte{}, fmt.Sprintf("%x", iconHash))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+	if _, err := icons.Store(image); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to store icon: "+err.Error())
 	}
 
-	iconID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 他のノードへの反映はDBにコミットしてから行う
+	if err := icons.Publish(ctx, image); err != nil {
+		c.Logger().Warnf("failed to publish icon to peers: %v", err)
+	}
+	for _, hash := range garbage {
+		if err := icons.Delete(hash); err != nil {
+			c.Logger().Warnf("failed to delete unreferenced icon: %v", err)
+		}
+		if err := icons.Unpublish(ctx, hash); err != nil {
+			c.Logger().Warnf("failed to delete unreferenced icon on peers: %v", err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, &PostIconResponse{
+		ID: iconID,
+	})
+}
+
+func getMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	filename := filepath.Join("../icons", fmt.Sprintf("%s.jpg", userName))
-	f, err := os.Create(filename)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
 
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
-	defer f.Close()
 
-	reader := bytes.NewReader(req.Image)
-	_, err = io.Copy(f, reader)
+	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
-		return fmt.Errorf("failed to copy image: %w", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, &PostIconResponse{
-		ID: iconID,
-	})
+	c.Response().Header().Set("ETag", userETag(userModel.Version))
+	return c.JSON(http.StatusOK, user)
 }
 
-func getMeHandler(c echo.Context) error {
+// プロフィール変更API
+// PATCH /api/user/me
+// GET /api/user/me で得たETagを If-Match に付け、その間に変更されていれば 412 を返す
+func patchMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -175,6 +414,19 @@ func getMeHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	ifMatch := c.Request().Header.Get("If-Match")
+	if ifMatch == "" {
+		return echo.NewHTTPError(http.StatusPreconditionRequired, "If-Match header is required")
+	}
+
+	req := PatchUserRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validatePatchUserRequest(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -182,14 +434,43 @@ func getMeHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
+	if err := ifMatchError(ifMatch, userETag(userModel.Version)); err != nil {
+		return err
+	}
 
+	if req.DisplayName != nil {
+		userModel.DisplayName = *req.DisplayName
+	}
+	if req.Description != nil {
+		userModel.Description = *req.Description
+	}
+	userModel.Version++
+	if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description, version = :version WHERE id = :id", userModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+	}
+	if req.Theme != nil {
+		themeModel := ThemeModel{}
+		if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ? FOR UPDATE", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+		}
+		applyPatchUserRequestTheme(&themeModel, *req.Theme)
+		// 色のコントラストは変更しなかったフィールドと組み合わせて確かめる
+		if err := validateThemeContrast(themeModel); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if _, err := tx.NamedExecContext(ctx, "UPDATE themes SET dark_mode = :dark_mode, accent_color = :accent_color, background_color = :background_color, banner_url = :banner_url, font_scale = :font_scale WHERE id = :id", themeModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+		}
+	}
+
+	// fillUsersResponse などはDBから読み直すので、コミットすれば変更が反映される
 	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
@@ -199,6 +480,7 @@ func getMeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	c.Response().Header().Set("ETag", userETag(userModel.Version))
 	return c.JSON(http.StatusOK, user)
 }
 
@@ -213,11 +495,14 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	if req.Name == "pipe" {
-		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
+	if err := validateNewUsername(req.Name); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	hashedPassword, err := hashPassword(ctx, req.Password)
+	if errors.Is(err, errPasswordHashBusy) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
@@ -268,9 +553,12 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	userNameLock.Lock()
-	defer userNameLock.Unlock()
-	userNames[req.Name] = true
+	userShards.SetUserID(req.Name, userID)
+	userNames.Add(req.Name)
+	if err := dnsSync.Publish(ctx, DNSSyncUser{ID: userID, Name: req.Name}); err != nil {
+		// 届かなかったピアはポーリングで追いつくので、登録自体は成功とする
+		c.Logger().Warnf("failed to publish dns name: %v", err)
+	}
 
 	return c.JSON(http.StatusCreated, user)
 }
@@ -286,6 +574,27 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	if err := validateUsername(req.Username); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	throttleKeys := loginThrottleKeys(c, req.Username)
+	attempt, wait, err := reserveLoginAttempt(ctx, throttleKeys)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if wait > 0 {
+		return tooManyLoginAttempts(c, wait)
+	}
+	// 失敗と確定しなかった試行は、サーバー側のエラーも含めて数えない
+	defer releaseLoginAttempt(c, attempt)
+	loginFailed := func() error {
+		if err := attempt.Fail(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -296,7 +605,8 @@ func loginHandler(c echo.Context) error {
 	// usernameはUNIQUEなので、whereで一意に特定できる
 	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		// 存在しないユーザ名も数えて、ユーザ名の有無で振る舞いを変えない
+		return loginFailed()
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
@@ -306,38 +616,67 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
+	err = comparePassword(ctx, userModel.HashedPassword, req.Password)
 	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		return loginFailed()
+	}
+	if errors.Is(err, errPasswordHashBusy) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
+	if passwordNeedsRehash(userModel.HashedPassword) {
+		// 失敗してもログインはさせ、次のログインでまたハッシュし直す
+		if err := rehashPassword(ctx, userModel, req.Password); err != nil {
+			c.Logger().Warnf("failed to rehash password: %v", err)
+		}
+	}
+
+	totpEnabled, err := isTOTPEnabled(ctx, userModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get totp: "+err.Error())
+	}
+	releaseLoginAttempt(c, attempt)
+	if totpEnabled {
+		// 二段階目が済むまではログインさせず、それまでの失敗の回数もそのまま残す
+		return startPendingTOTPLogin(c, userModel)
+	}
+
+	if err := resetLoginFailures(ctx, throttleKeys); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := startUserSession(c, userModel); err != nil {
+		return err
+	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	return c.NoContent(http.StatusOK)
+}
 
-	sessionID := uuid.NewString()
+// startUserSession はサーバー側のセッションを作り、クッキーにログインしたユーザを保存します
+func startUserSession(c echo.Context, userModel UserModel) error {
+	serverSession, err := userSessions.Create(c.Request().Context(), userModel.ID, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session: "+err.Error())
+	}
 
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.dev",
-		MaxAge: int(60000),
-		Path:   "/",
-	}
-	sess.Values[defaultSessionIDKey] = sessionID
+	sess.Options = sessionCookieOptions(sessionCookieMaxAge)
+	delete(sess.Values, pendingTOTPUserIDKey)
+	delete(sess.Values, pendingTOTPExpiresKey)
+	sess.Values[defaultSessionIDKey] = serverSession.ID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
-	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
+	sess.Values[defaultSessionExpiresKey] = serverSession.ExpiresAt
 
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
-
-	return c.NoContent(http.StatusOK)
+	return nil
 }
 
 // ユーザ詳細API
@@ -349,7 +688,10 @@ func getUserHandler(c echo.Context) error {
 		return err
 	}
 
-	username := c.Param("username")
+	username, err := usernameParam(c)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -398,6 +740,19 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
+	// ログアウトやパスワードの変更で失効していないか、サーバー側のセッションで確かめる
+	sessionID, ok := sess.Values[defaultSessionIDKey].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get SESSIONID value from session")
+	}
+	serverSession, ok, err := userSessions.Get(c.Request().Context(), sessionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !ok || serverSession.UserID != sess.Values[defaultUserIDKey].(int64) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "session has been revoked")
+	}
+
 	return nil
 }
 
@@ -427,11 +782,8 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 		Name:        userModel.Name,
 		DisplayName: userModel.DisplayName,
 		Description: userModel.Description,
-		Theme: Theme{
-			ID:       themeModel.ID,
-			DarkMode: themeModel.DarkMode,
-		},
-		IconHash: imageHash.String,
+		Theme:       themeFromModel(themeModel),
+		IconHash:    imageHash.String,
 	}
 
 	return user, nil
@@ -440,9 +792,13 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 type UserAndIconAndTheme struct {
 	UserModel
 	// Theme
-	ThemeID   int64          `db:"theme_id"`
-	DarkMode  bool           `db:"dark_mode"`
-	ImageHash sql.NullString `db:"image_hash"`
+	ThemeID         int64          `db:"theme_id"`
+	DarkMode        bool           `db:"dark_mode"`
+	AccentColor     string         `db:"accent_color"`
+	BackgroundColor string         `db:"background_color"`
+	BannerURL       string         `db:"banner_url"`
+	FontScale       string         `db:"font_scale"`
+	ImageHash       sql.NullString `db:"image_hash"`
 }
 
 func fillUsersResponse(ctx context.Context, tx *sqlx.Tx, userIDs []int64) ([]User, error) {
@@ -454,7 +810,7 @@ func fillUsersResponse(ctx context.Context, tx *sqlx.Tx, userIDs []int64) ([]Use
 	uniqUserIDs := slices.Compact(userIDs)
 
 	var userAndIconAndThemes []UserAndIconAndTheme
-	q, args, err := sqlx.In("SELECT users.*, themes.id AS theme_id, themes.dark_mode, icons.image_hash FROM users LEFT JOIN themes ON users.id = themes.user_id LEFT JOIN icons ON users.id = icons.user_id WHERE users.id IN (?)", uniqUserIDs)
+	q, args, err := sqlx.In("SELECT users.*, themes.id AS theme_id, themes.dark_mode, themes.accent_color, themes.background_color, themes.banner_url, themes.font_scale, icons.image_hash FROM users LEFT JOIN themes ON users.id = themes.user_id LEFT JOIN icons ON users.id = icons.user_id WHERE users.id IN (?)", uniqUserIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -481,10 +837,14 @@ func fillUsersResponse(ctx context.Context, tx *sqlx.Tx, userIDs []int64) ([]Use
 			Name:        userAndIconAndTheme.Name,
 			DisplayName: userAndIconAndTheme.DisplayName,
 			Description: userAndIconAndTheme.Description,
-			Theme: Theme{
-				ID:       userAndIconAndTheme.ThemeID,
-				DarkMode: userAndIconAndTheme.DarkMode,
-			},
+			Theme: themeFromModel(ThemeModel{
+				ID:              userAndIconAndTheme.ThemeID,
+				DarkMode:        userAndIconAndTheme.DarkMode,
+				AccentColor:     userAndIconAndTheme.AccentColor,
+				BackgroundColor: userAndIconAndTheme.BackgroundColor,
+				BannerURL:       userAndIconAndTheme.BannerURL,
+				FontScale:       userAndIconAndTheme.FontScale,
+			}),
 			IconHash: userAndIconAndTheme.ImageHash.String,
 		}
 	}
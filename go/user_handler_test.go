@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"0123abcd"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: `"0123abcd"`, want: true},
+		{header: `W/"0123abcd"`, want: true},
+		{header: `"ffff", "0123abcd"`, want: true},
+		{header: `"ffff"`, want: false},
+		{header: "*", want: true},
+		{header: `0123abcd`, want: false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestEtagMatchesStrong(t *testing.T) {
+	etag := `"user-v3"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: `"user-v3"`, want: true},
+		{header: `W/"user-v3"`, want: false},
+		{header: `"user-v2", "user-v3"`, want: true},
+		{header: `"user-v2"`, want: false},
+		{header: "*", want: true},
+	}
+	for _, tt := range tests {
+		if got := etagMatchesStrong(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatchesStrong(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	// 弱いETagで更新しようとすると 412
+	err := ifMatchError(`W/"user-v3"`, etag)
+	if he, ok := err.(*echo.HTTPError); !ok || he.Code != http.StatusPreconditionFailed {
+		t.Errorf("want 412 for a weak etag, got %v", err)
+	}
+	if err := ifMatchError(etag, etag); err != nil {
+		t.Errorf("want no error for a matching etag, got %v", err)
+	}
+}
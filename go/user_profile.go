@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// プロフィールの検証。
+// 長さは文字数で数え、users テーブルの列に収まるようにする。
+const (
+	displayNameMaxLength = 255
+	descriptionMaxLength = 2000
+)
+
+// userETag は GET /api/user/me と PATCH /api/user/me のETagです
+func userETag(version int64) string {
+	return fmt.Sprintf(`"user-v%d"`, version)
+}
+
+// validatePatchUserRequest はフィールドごとに検証し、すべてのエラーをまとめて返します
+func validatePatchUserRequest(req PatchUserRequest) error {
+	if req.DisplayName == nil && req.Description == nil && (req.Theme == nil || *req.Theme == PatchUserRequestTheme{}) {
+		return errors.New("no fields to update")
+	}
+	var errs []error
+	if req.DisplayName != nil {
+		if err := validateProfileText(*req.DisplayName, displayNameMaxLength, false); err != nil {
+			errs = append(errs, fmt.Errorf("display_name: %w", err))
+		} else if strings.TrimSpace(*req.DisplayName) == "" {
+			errs = append(errs, errors.New("display_name: must not be empty"))
+		}
+	}
+	if req.Description != nil {
+		if err := validateProfileText(*req.Description, descriptionMaxLength, true); err != nil {
+			errs = append(errs, fmt.Errorf("description: %w", err))
+		}
+	}
+	if theme := req.Theme; theme != nil {
+		for _, color := range []struct {
+			name  string
+			value *string
+		}{{"theme.accent_color", theme.AccentColor}, {"theme.background_color", theme.BackgroundColor}} {
+			if color.value == nil {
+				continue
+			}
+			if _, err := normalizeThemeColor(*color.value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", color.name, err))
+			}
+		}
+		if theme.BannerURL != nil {
+			if err := validateThemeBannerURL(*theme.BannerURL); err != nil {
+				errs = append(errs, fmt.Errorf("theme.banner_url: %w", err))
+			}
+		}
+		if theme.FontScale != nil {
+			if err := validateThemeFontScale(*theme.FontScale); err != nil {
+				errs = append(errs, fmt.Errorf("theme.font_scale: %w", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyPatchUserRequestTheme は検証済みの変更をテーマに反映します
+func applyPatchUserRequestTheme(m *ThemeModel, theme PatchUserRequestTheme) {
+	if theme.DarkMode != nil {
+		m.DarkMode = *theme.DarkMode
+	}
+	if theme.AccentColor != nil {
+		m.AccentColor, _ = normalizeThemeColor(*theme.AccentColor)
+	}
+	if theme.BackgroundColor != nil {
+		m.BackgroundColor, _ = normalizeThemeColor(*theme.BackgroundColor)
+	}
+	if theme.BannerURL != nil {
+		m.BannerURL = *theme.BannerURL
+	}
+	if theme.FontScale != nil {
+		m.FontScale = *theme.FontScale
+	}
+}
+
+// validateProfileText は長さと使える文字を確かめます。改行は multiline のときだけ許す。
+func validateProfileText(s string, maxLength int, multiline bool) error {
+	if !utf8.ValidString(s) {
+		return errors.New("must be valid UTF-8")
+	}
+	if n := utf8.RuneCountInString(s); n > maxLength {
+		return fmt.Errorf("must be at most %d characters, got %d", maxLength, n)
+	}
+	for _, r := range s {
+		if r == '\n' && multiline {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return fmt.Errorf("must not contain control characters: %U", r)
+		}
+	}
+	return nil
+}
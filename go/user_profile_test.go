@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePatchUserRequest(t *testing.T) {
+	str := func(s string) *string { return &s }
+	darkMode := true
+
+	for _, req := range []PatchUserRequest{
+		{DisplayName: str("ありす")},
+		{Description: str("よろしくおねがいします！\n\n連絡は以下からお願いします。")},
+		{Description: str("")},
+		{Theme: &PatchUserRequestTheme{DarkMode: &darkMode}},
+		{DisplayName: str(strings.Repeat("あ", displayNameMaxLength))},
+	} {
+		if err := validatePatchUserRequest(req); err != nil {
+			t.Errorf("%+v must be valid: %v", req, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		req  PatchUserRequest
+		want []string
+	}{
+		{req: PatchUserRequest{}, want: []string{"no fields"}},
+		{req: PatchUserRequest{Theme: &PatchUserRequestTheme{}}, want: []string{"no fields"}},
+		{req: PatchUserRequest{DisplayName: str(" ")}, want: []string{"display_name: must not be empty"}},
+		{req: PatchUserRequest{DisplayName: str("a\nb")}, want: []string{"display_name: must not contain control characters"}},
+		{req: PatchUserRequest{DisplayName: str("\xff")}, want: []string{"display_name: must be valid UTF-8"}},
+		// すべてのフィールドのエラーを返す
+		{
+			req:  PatchUserRequest{DisplayName: str(strings.Repeat("a", displayNameMaxLength+1)), Description: str("\x00")},
+			want: []string{"display_name: must be at most", "description: must not contain control characters"},
+		},
+	} {
+		err := validatePatchUserRequest(tt.req)
+		if err == nil {
+			t.Errorf("%+v must be invalid", tt.req)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("want %q in %q", want, err)
+			}
+		}
+	}
+}
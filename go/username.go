@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザ名の検証。
+// ユーザ名はそのまま本番のゾーンのサブドメインになるので、DNSのラベルとして使えるLDH (英小文字、数字、ハイフン) に限る。
+// 大文字はDNSでは小文字と区別されず別のユーザと衝突するので受け付けない。
+// 登録するときは、ゾーンファイルにあるサブドメイン (www や mail など) も予約済みとして受け付けない。
+const (
+	// usernameMaxLength はDNSのラベルの長さの上限です
+	usernameMaxLength = 63
+)
+
+// reservedUsernames はゾーンファイルに無くても登録させない名前です
+var reservedUsernames = []string{"pipe"}
+
+var errInvalidUsername = errors.New("invalid username")
+
+// validateUsername はユーザ名がDNSのラベルとして使えるか確かめます
+func validateUsername(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: username is empty", errInvalidUsername)
+	}
+	if len(name) > usernameMaxLength {
+		return fmt.Errorf("%w: username must be at most %d characters", errInvalidUsername, usernameMaxLength)
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-') {
+			return fmt.Errorf("%w: username must consist of lowercase letters, digits and hyphens: %q", errInvalidUsername, name)
+		}
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return fmt.Errorf("%w: username must not start or end with a hyphen", errInvalidUsername)
+	}
+	// "xn--" などの3、4文字目のハイフンは国際化ドメイン名のために予約されている
+	if len(name) >= 4 && name[2:4] == "--" {
+		return fmt.Errorf("%w: username must not have hyphens in the third and fourth characters", errInvalidUsername)
+	}
+	return nil
+}
+
+// validateNewUsername は登録しようとしているユーザ名を確かめます
+func validateNewUsername(name string) error {
+	if err := validateUsername(name); err != nil {
+		return err
+	}
+	if isReservedUsername(name) {
+		return fmt.Errorf("%w: the username '%s' is reserved", errInvalidUsername, name)
+	}
+	return nil
+}
+
+// isReservedUsername は name が予約済みなら true を返します。
+// ゾーンファイルにある名前と、その下にレコードがある名前 (_dmarc.mail の mail など) を予約済みとする。
+func isReservedUsername(name string) bool {
+	for _, reserved := range reservedUsernames {
+		if name == reserved {
+			return true
+		}
+	}
+	zone := primaryZone()
+	if zone == nil {
+		return false
+	}
+	zf := zone.file.Load()
+	if zf == nil {
+		return false
+	}
+	if len(zf.lookup(zone.fqdnOf(name))) > 0 {
+		return true
+	}
+	for _, subDomain := range zf.Subdomains {
+		if strings.HasSuffix(subDomain, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// usernameParam はパスの :username を検証して返します
+func usernameParam(c echo.Context) (string, error) {
+	username := c.Param("username")
+	if err := validateUsername(username); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return username, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	for _, name := range []string{"alice", "test001", "a", "abe-jun0", "0", strings.Repeat("a", 63)} {
+		if err := validateUsername(name); err != nil {
+			t.Errorf("%q must be valid: %v", name, err)
+		}
+	}
+	for _, name := range []string{
+		"",
+		"Alice",
+		"alice.bob",
+		"alice_bob",
+		"-alice",
+		"alice-",
+		"xn--alice",
+		"ありす",
+		strings.Repeat("a", 64),
+	} {
+		if err := validateUsername(name); !errors.Is(err, errInvalidUsername) {
+			t.Errorf("%q must be invalid, got %v", name, err)
+		}
+	}
+}
+
+func TestValidateNewUsername(t *testing.T) {
+	prevZones := hostedZones
+	t.Cleanup(func() { hostedZones = prevZones })
+
+	zf, err := parseZone([]byte(testZone+"_dmarc.mail 0 IN TXT \"v=DMARC1\"\n"), domain, "test")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+	hz, err := newHostedZone(dnsZoneConfig{Name: domain}, false)
+	if err != nil {
+		t.Fatalf("failed to create zone: %v", err)
+	}
+	hz.setFile(zf)
+	hostedZones = []*hostedZone{hz}
+
+	// ゾーンファイルにある名前と、その下にレコードがある名前は登録できない
+	for _, name := range []string{"pipe", "www", "ns1", "mail"} {
+		if err := validateNewUsername(name); !errors.Is(err, errInvalidUsername) {
+			t.Errorf("%q must be reserved, got %v", name, err)
+		}
+	}
+	if err := validateNewUsername("alice"); err != nil {
+		t.Errorf("alice must be available: %v", err)
+	}
+	// 予約済みの名前でも、既存のユーザとして引くことはできる
+	if err := validateUsername("www"); err != nil {
+		t.Errorf("www must be a valid username: %v", err)
+	}
+}
@@ -1,5 +1,99 @@
+-- 既存のDBには後から追加したテーブルが無いので、TRUNCATEの前に作っておく
+CREATE TABLE IF NOT EXISTS `icon_blobs` (
+  `hash` CHAR(64) NOT NULL PRIMARY KEY,
+  `image` LONGBLOB NOT NULL,
+  `ref_count` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `id` VARCHAR(36) NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `user_agent` VARCHAR(255) NOT NULL,
+  `remote_addr` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  INDEX `sessions_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS `login_failures` (
+  `scope` VARCHAR(8) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `failures` BIGINT NOT NULL,
+  `last_failed_at` BIGINT NOT NULL,
+  `retry_at` BIGINT NOT NULL,
+  `pending` BIGINT NOT NULL DEFAULT 0,
+  `pending_at` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`scope`, `name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS `login_lockouts` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `scope` VARCHAR(8) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `failures` BIGINT NOT NULL,
+  `locked_until` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS `password_reset_tokens` (
+  `token_hash` CHAR(64) NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  INDEX `password_reset_tokens_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS `user_totp` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `secret` VARCHAR(64) NOT NULL,
+  `enabled` BOOLEAN NOT NULL,
+  `last_used_step` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS `totp_recovery_codes` (
+  `user_id` BIGINT NOT NULL,
+  `code_hash` CHAR(64) NOT NULL,
+  PRIMARY KEY (`user_id`, `code_hash`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 既存のDBには後から追加した列も無い。MySQLには ADD COLUMN IF NOT EXISTS が無いので、無いときだけ追加する
+SET @ddl = IF(
+  (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'users' AND column_name = 'version') = 0,
+  'ALTER TABLE `users` ADD COLUMN `version` BIGINT NOT NULL DEFAULT 0',
+  'SELECT 1'
+);
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF(
+  (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'themes' AND column_name = 'accent_color') = 0,
+  'ALTER TABLE `themes` ADD COLUMN `accent_color` VARCHAR(7) NOT NULL DEFAULT \'\', ADD COLUMN `background_color` VARCHAR(7) NOT NULL DEFAULT \'\', ADD COLUMN `banner_url` VARCHAR(2048) NOT NULL DEFAULT \'\', ADD COLUMN `font_scale` VARCHAR(16) NOT NULL DEFAULT \'\'',
+  'SELECT 1'
+);
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF(
+  (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'login_failures' AND column_name = 'pending') = 0,
+  'ALTER TABLE `login_failures` ADD COLUMN `pending` BIGINT NOT NULL DEFAULT 0, ADD COLUMN `pending_at` BIGINT NOT NULL DEFAULT 0',
+  'SELECT 1'
+);
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
+TRUNCATE TABLE icon_blobs;
+TRUNCATE TABLE sessions;
+TRUNCATE TABLE login_failures;
+TRUNCATE TABLE login_lockouts;
+TRUNCATE TABLE password_reset_tokens;
+TRUNCATE TABLE user_totp;
+TRUNCATE TABLE totp_recovery_codes;
 TRUNCATE TABLE reservation_slots;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
@@ -13,6 +107,7 @@ TRUNCATE TABLE users;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
+ALTER TABLE `login_lockouts` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
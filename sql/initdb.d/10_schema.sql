@@ -7,6 +7,7 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
+  `version` BIGINT NOT NULL DEFAULT 0,
   UNIQUE `uniq_user_name` (`name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -17,11 +18,81 @@ CREATE TABLE `icons` (
   `image` LONGBLOB NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- プロフィール画像の本体 (SHA-256で引き、同じ画像は1度だけ保存する)
+CREATE TABLE `icon_blobs` (
+  `hash` CHAR(64) NOT NULL PRIMARY KEY,
+  `image` LONGBLOB NOT NULL,
+  `ref_count` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ログイン中のセッション (ログアウトやパスワード変更で削除して失効させる)
+CREATE TABLE `sessions` (
+  `id` VARCHAR(36) NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `user_agent` VARCHAR(255) NOT NULL,
+  `remote_addr` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  INDEX `sessions_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ログインに失敗した回数 (scopeは user か ip)
+CREATE TABLE `login_failures` (
+  `scope` VARCHAR(8) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `failures` BIGINT NOT NULL,
+  `last_failed_at` BIGINT NOT NULL,
+  `retry_at` BIGINT NOT NULL,
+  `pending` BIGINT NOT NULL DEFAULT 0,
+  `pending_at` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`scope`, `name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ログインの失敗が続いてロックしたときの記録 (運営者が確認する)
+CREATE TABLE `login_lockouts` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `scope` VARCHAR(8) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `failures` BIGINT NOT NULL,
+  `locked_until` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- パスワード再設定のトークン (トークンそのものではなくSHA-256を保存する)
+CREATE TABLE `password_reset_tokens` (
+  `token_hash` CHAR(64) NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  INDEX `password_reset_tokens_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- TOTPによる二段階認証。確認が済むまでは enabled = FALSE
+CREATE TABLE `user_totp` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `secret` VARCHAR(64) NOT NULL,
+  `enabled` BOOLEAN NOT NULL,
+  -- 同じコードを二度使わせないよう、最後に受け付けたステップを覚えておく
+  `last_used_step` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE `totp_recovery_codes` (
+  `user_id` BIGINT NOT NULL,
+  `code_hash` CHAR(64) NOT NULL,
+  PRIMARY KEY (`user_id`, `code_hash`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ユーザごとのカスタムテーマ
 CREATE TABLE `themes` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `dark_mode` BOOLEAN NOT NULL
+  `dark_mode` BOOLEAN NOT NULL,
+  -- 以下は空なら既定の見た目を使う
+  `accent_color` VARCHAR(7) NOT NULL DEFAULT '',
+  `background_color` VARCHAR(7) NOT NULL DEFAULT '',
+  `banner_url` VARCHAR(2048) NOT NULL DEFAULT '',
+  `font_scale` VARCHAR(16) NOT NULL DEFAULT ''
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信